@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Luzifer/go_helpers/v2/str"
+	"github.com/pkg/errors"
+)
+
+const browserHelp = `Available commands:
+  ls                 List the current directory
+  cd <dir>           Change into directory (".." to go up)
+  add <name> | *     Select file / directory (or everything) for restore
+  rm <name> | *      Remove file / directory (or everything) from selection
+  selected           Show selected files / directories
+  restore <target>   Restore the selection into the target directory
+  help               Show this help
+  quit               Exit without restoring
+`
+
+type restoreBrowser struct {
+	config *configFile
+	in     *bufio.Scanner
+	out    io.Writer
+
+	set      backupSet
+	children map[string][]string
+	cwd      string
+	selected map[string]bool
+}
+
+// runRestoreBrowser starts an interactive terminal session to select a
+// backup, browse its contents and restore a selection of files
+func runRestoreBrowser(config *configFile) error {
+	b := &restoreBrowser{
+		config:   config,
+		in:       bufio.NewScanner(os.Stdin),
+		out:      os.Stdout,
+		selected: map[string]bool{},
+	}
+
+	return b.run()
+}
+
+func (b *restoreBrowser) run() error {
+	sets, err := b.config.listBackupSets()
+	if err != nil {
+		return errors.Wrap(err, "listing backups")
+	}
+
+	if len(sets) == 0 {
+		return errors.New("no backups found")
+	}
+
+	if b.set, err = b.selectSet(sets); err != nil {
+		return err
+	}
+
+	files, err := b.config.cachedFileList(b.set)
+	if err != nil {
+		return errors.Wrap(err, "listing files")
+	}
+
+	b.buildTree(files)
+	b.printf("\n%s", browserHelp)
+
+	for {
+		b.printf("/%s > ", b.cwd)
+		if !b.in.Scan() {
+			return errors.Wrap(b.in.Err(), "reading input")
+		}
+
+		cmd, arg, _ := strings.Cut(strings.TrimSpace(b.in.Text()), " ")
+		done, err := b.handle(cmd, strings.TrimSpace(arg))
+		if err != nil {
+			b.printf("Error: %s\n", err)
+		}
+
+		if done {
+			return err
+		}
+	}
+}
+
+func (b *restoreBrowser) selectSet(sets []backupSet) (backupSet, error) {
+	b.printf("Available backups:\n")
+	for i, s := range sets {
+		b.printf("  [%d] %-12s %s\n", i+1, s.Type, s.Time.Format("2006-01-02 15:04:05"))
+	}
+
+	for {
+		b.printf("Select backup [%d]: ", len(sets))
+		if !b.in.Scan() {
+			return backupSet{}, errors.Wrap(b.in.Err(), "reading input")
+		}
+
+		input := strings.TrimSpace(b.in.Text())
+		if input == "" {
+			return sets[len(sets)-1], nil
+		}
+
+		if n, err := strconv.Atoi(input); err == nil && n > 0 && n <= len(sets) {
+			return sets[n-1], nil
+		}
+
+		b.printf("Invalid selection %q\n", input)
+	}
+}
+
+func (b *restoreBrowser) buildTree(files []backupFile) {
+	b.children = map[string][]string{"": nil}
+
+	for _, f := range files {
+		parent := path.Dir(f.Path)
+		if parent == "." {
+			parent = ""
+		}
+		b.children[parent] = append(b.children[parent], path.Base(f.Path))
+	}
+
+	for _, c := range b.children {
+		sort.Strings(c)
+	}
+}
+
+//nolint:gocyclo // Simple list of commands
+func (b *restoreBrowser) handle(cmd, arg string) (done bool, err error) {
+	switch cmd {
+	case "":
+		// Empty input, just prompt again
+
+	case "ls":
+		for _, name := range b.children[b.cwd] {
+			p := path.Join(b.cwd, name)
+
+			flags := " "
+			if b.selected[p] {
+				flags = "*"
+			}
+
+			if _, isDir := b.children[p]; isDir {
+				name += "/"
+			}
+
+			b.printf("%s %s\n", flags, name)
+		}
+
+	case "cd":
+		return false, b.changeDir(arg)
+
+	case "add", "rm":
+		return false, b.changeSelection(arg, cmd == "add")
+
+	case "selected":
+		for _, p := range b.selection() {
+			b.printf("  /%s\n", p)
+		}
+
+	case "restore":
+		if arg == "" {
+			return false, errors.New("no target given")
+		}
+		return true, b.restore(arg)
+
+	case "help":
+		b.printf("%s", browserHelp)
+
+	case "quit", "exit":
+		return true, nil
+
+	default:
+		return false, errors.Errorf("unknown command %q, see help", cmd)
+	}
+
+	return false, nil
+}
+
+func (b *restoreBrowser) changeDir(arg string) error {
+	var target string
+
+	switch {
+	case arg == "" || arg == "/":
+		target = ""
+	case strings.HasPrefix(arg, "/"):
+		target = path.Clean(strings.TrimPrefix(arg, "/"))
+	default:
+		target = path.Join(b.cwd, arg)
+	}
+
+	if target == "." || strings.HasPrefix(target, "..") {
+		target = ""
+	}
+
+	if _, isDir := b.children[target]; !isDir {
+		return errors.Errorf("%q is not a directory", arg)
+	}
+
+	b.cwd = target
+	return nil
+}
+
+//revive:disable-next-line:flag-parameter // Keeping for the sake of simplicity
+func (b *restoreBrowser) changeSelection(arg string, add bool) error {
+	if arg == "" {
+		return errors.New("no name given")
+	}
+
+	names := []string{arg}
+	if arg == "*" {
+		names = b.children[b.cwd]
+	}
+
+	for _, name := range names {
+		p := path.Join(b.cwd, name)
+		if !str.StringInSlice(name, b.children[b.cwd]) {
+			return errors.Errorf("%q does not exist", name)
+		}
+
+		if add {
+			b.selected[p] = true
+		} else {
+			delete(b.selected, p)
+		}
+	}
+
+	return nil
+}
+
+// selection returns the selected paths without those already contained
+// in a selected parent directory
+func (b *restoreBrowser) selection() []string {
+	var out []string
+
+	for p := range b.selected {
+		covered := false
+		for d := path.Dir(p); d != "."; d = path.Dir(d) {
+			if b.selected[d] {
+				covered = true
+				break
+			}
+		}
+
+		if !covered {
+			out = append(out, p)
+		}
+	}
+
+	sort.Strings(out)
+	return out
+}
+
+func (b *restoreBrowser) restore(target string) error {
+	selection := b.selection()
+	if len(selection) == 0 {
+		return errors.New("nothing selected")
+	}
+
+	return b.config.restoreMultiple(selection, target, b.set.duplicityTime())
+}
+
+func (b *restoreBrowser) printf(format string, args ...any) {
+	fmt.Fprintf(b.out, format, args...)
+}
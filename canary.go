@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	canaryFilePerms      = 0o600
+	canaryRandomBytes    = 32
+	defaultCanaryRelPath = ".duplicity-backup-canary"
+)
+
+// canaryPath returns the path of the canary file relative to the root
+// in the form duplicity uses in its listings
+func (c *configFile) canaryPath() string {
+	if c.Canary.Path == "" {
+		return defaultCanaryRelPath
+	}
+
+	return c.relativeBackupPath(c.Canary.Path)
+}
+
+// writeCanary creates a new canary file with a timestamp and random
+// content inside the root to be picked up by the next backup
+func (c *configFile) writeCanary() error {
+	if !c.Canary.Enable || cfg.DryRun {
+		return nil
+	}
+
+	random := make([]byte, canaryRandomBytes)
+	if _, err := rand.Read(random); err != nil {
+		return errors.Wrap(err, "generating random content")
+	}
+
+	content := fmt.Sprintf("duplicity-backup canary\nhost: %s\nwritten: %s\nrandom: %x\n",
+		c.Hostname, time.Now().Format(time.RFC3339), random)
+
+	canaryFile := filepath.Join(c.RootPath, filepath.FromSlash(c.canaryPath()))
+	if err := os.WriteFile(canaryFile, []byte(content), canaryFilePerms); err != nil {
+		return errors.Wrap(err, "writing canary file")
+	}
+
+	logrus.Debugf("Canary file written to %q", canaryFile)
+	return nil
+}
+
+// runCanaryCheck restores the canary file from the latest backup and
+// compares it to the one written before that backup
+func runCanaryCheck(config *configFile) error {
+	err := config.checkCanary()
+	if err != nil {
+		logrus.WithError(err).Error("Canary check failed")
+
+		notifyFailure(config, commandCheckCanary, err)
+	}
+
+	return err
+}
+
+func (c *configFile) checkCanary() error {
+	if !c.Canary.Enable {
+		return errors.New("canary file is not enabled in config")
+	}
+
+	tmpDir, err := os.MkdirTemp(c.RestoreTest.TempDir, "duplicity-backup-canary-")
+	if err != nil {
+		return errors.Wrap(err, "creating temporary directory")
+	}
+	defer func() {
+		if err := os.RemoveAll(tmpDir); err != nil {
+			logrus.WithError(err).Error("removing temporary directory")
+		}
+	}()
+
+	target := filepath.Join(tmpDir, "canary")
+	if err = runDuplicity(c, []string{commandRestore, c.canaryPath(), target}, "", nil); err != nil {
+		return errors.Wrap(err, "restoring canary file")
+	}
+
+	restored, err := os.ReadFile(target) //#nosec:G304 // Path is built from our temp dir
+	if err != nil {
+		return errors.Wrap(err, "reading restored canary file")
+	}
+
+	live, err := os.ReadFile(filepath.Join(c.RootPath, filepath.FromSlash(c.canaryPath())))
+	if err != nil {
+		return errors.Wrap(err, "reading live canary file")
+	}
+
+	if !bytes.Equal(restored, live) {
+		return errors.New("restored canary file does not match the one written before the latest backup")
+	}
+
+	logrus.Info("Canary file restored and verified successfully")
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Canary", func() {
+	var (
+		config  *configFile
+		tmp     string
+		root    string
+		origBin = duplicityBinary
+		// fakeRestore lets the restore write the given content to the
+		// target passed as last argument
+		fakeRestore = func(source string) {
+			duplicityBinary = filepath.Join(tmp, "duplicity")
+			Expect(os.WriteFile(duplicityBinary, []byte("#!/bin/sh\neval target=\\${$#}\ncp '"+source+"' \"$target\"\n"), 0o700)).To(Succeed()) //#nosec:G306 // Fake binary needs to be executable
+		}
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = os.MkdirTemp("", "duplicity-backup-test-")
+		Expect(err).NotTo(HaveOccurred())
+
+		root = filepath.Join(tmp, "root")
+		Expect(os.Mkdir(root, 0o700)).To(Succeed())
+
+		config, err = loadConfigFile(strings.NewReader("root: " + root + "\ndest: file://" + tmp + "/dest\nlogdir: " + tmp + "\ncanary:\n  enable: true\n  path: canary.txt\n"))
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		duplicityBinary = origBin
+		Expect(os.RemoveAll(tmp)).To(Succeed())
+	})
+
+	It("should write a new canary for each backup", func() {
+		canary := filepath.Join(root, "canary.txt")
+
+		Expect(config.writeCanary()).To(Succeed())
+		first, err := os.ReadFile(canary)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(first)).To(HavePrefix("duplicity-backup canary\n"))
+
+		Expect(config.writeCanary()).To(Succeed())
+		second, err := os.ReadFile(canary)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(second).NotTo(Equal(first))
+	})
+
+	It("should not write the canary when disabled", func() {
+		config.Canary.Enable = false
+
+		Expect(config.writeCanary()).To(Succeed())
+		Expect(filepath.Join(root, "canary.txt")).NotTo(BeAnExistingFile())
+		Expect(config.checkCanary()).To(MatchError("canary file is not enabled in config"))
+	})
+
+	It("should verify the restored canary", func() {
+		Expect(config.writeCanary()).To(Succeed())
+
+		fakeRestore(filepath.Join(root, "canary.txt"))
+		Expect(config.checkCanary()).To(Succeed())
+	})
+
+	It("should detect a restored canary not matching the live one", func() {
+		Expect(config.writeCanary()).To(Succeed())
+
+		outdated := filepath.Join(tmp, "outdated.txt")
+		Expect(os.WriteFile(outdated, []byte("duplicity-backup canary\n"), 0o600)).To(Succeed())
+
+		fakeRestore(outdated)
+		Expect(config.checkCanary()).To(MatchError(ContainSubstring("does not match")))
+	})
+})
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const outputFormatCSV = "csv"
+
+var (
+	changedFileLine = regexp.MustCompile(`^([ADM]) (.+)$`)
+	backupStatLine  = regexp.MustCompile(`^(SourceFiles|NewFiles|DeletedFiles|ChangedFiles) (\d+)`)
+)
+
+type (
+	fileChange struct {
+		Action string `json:"action"`
+		Path   string `json:"path"`
+	}
+
+	changeCounts struct {
+		Added    int `json:"added"`
+		Deleted  int `json:"deleted"`
+		Modified int `json:"modified"`
+	}
+
+	changeReport struct {
+		Changes     []fileChange             `json:"changes"`
+		Total       changeCounts             `json:"total"`
+		Directories map[string]*changeCounts `json:"directories"`
+		// SourceFiles is the number of files in the backup source as
+		// reported by the duplicity statistics (-1 if not reported)
+		SourceFiles int `json:"source_files"`
+	}
+)
+
+// runListChangedFiles executes a dry-run backup and reports the files
+// which would be added, deleted or modified by the next backup
+func runListChangedFiles(config *configFile) error {
+	report, err := config.detectChanges()
+	if err != nil {
+		logrus.WithError(err).Error("detecting changes")
+		return err
+	}
+
+	switch cfg.OutputFormat {
+	case outputFormatCSV:
+		err = report.writeCSV(os.Stdout)
+	case outputFormatJSON:
+		err = json.NewEncoder(os.Stdout).Encode(report)
+	case outputFormatText:
+		err = report.writeText(os.Stdout)
+	default:
+		err = errors.Errorf("unsupported output format %q", cfg.OutputFormat)
+	}
+
+	if err != nil {
+		logrus.WithError(err).Error("writing changes")
+	}
+
+	return errors.Wrap(err, "writing changes")
+}
+
+// detectChanges executes the list-changed-files dry-run and parses its
+// output into a report
+func (c *configFile) detectChanges() (*changeReport, error) {
+	var lines []string
+
+	if err := runDuplicity(c, []string{commandListChangedFiles}, "", func(l string) {
+		lines = append(lines, l)
+	}); err != nil {
+		return nil, errors.Wrap(err, "executing dry-run")
+	}
+
+	return parseChangedFiles(lines), nil
+}
+
+func parseChangedFiles(lines []string) *changeReport {
+	report := &changeReport{
+		Changes:     []fileChange{},
+		Directories: map[string]*changeCounts{},
+		SourceFiles: -1,
+	}
+
+	stats := map[string]int{}
+
+	for _, l := range lines {
+		if m := backupStatLine.FindStringSubmatch(l); m != nil {
+			stats[m[1]], _ = strconv.Atoi(m[2]) // #nosec G104 // Regex ensures this is a number
+			continue
+		}
+
+		m := changedFileLine.FindStringSubmatch(l)
+		if m == nil || m[2] == "." {
+			continue
+		}
+
+		report.Changes = append(report.Changes, fileChange{Action: m[1], Path: m[2]})
+
+		dir, _, found := strings.Cut(m[2], "/")
+		if !found {
+			dir = "."
+		}
+
+		if report.Directories[dir] == nil {
+			report.Directories[dir] = &changeCounts{}
+		}
+
+		report.Total.count(m[1])
+		report.Directories[dir].count(m[1])
+	}
+
+	if n, ok := stats["SourceFiles"]; ok {
+		report.SourceFiles = n
+	}
+
+	return report
+}
+
+func (c *changeCounts) count(action string) {
+	switch action {
+	case "A":
+		c.Added++
+	case "D":
+		c.Deleted++
+	case "M":
+		c.Modified++
+	}
+}
+
+// previousFiles estimates the number of files contained in the latest
+// backup from the statistics and changes, returns -1 if unknown
+func (r changeReport) previousFiles() int {
+	if r.SourceFiles < 0 {
+		return -1
+	}
+
+	return r.SourceFiles - r.Total.Added + r.Total.Deleted
+}
+
+func (r changeReport) writeCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+
+	if err := cw.Write([]string{"action", "path"}); err != nil {
+		return errors.Wrap(err, "writing header")
+	}
+
+	for _, c := range r.Changes {
+		if err := cw.Write([]string{c.Action, c.Path}); err != nil {
+			return errors.Wrap(err, "writing change")
+		}
+	}
+
+	cw.Flush()
+	return errors.Wrap(cw.Error(), "flushing output")
+}
+
+func (r changeReport) writeText(w io.Writer) error {
+	var lines []string
+
+	for _, c := range r.Changes {
+		lines = append(lines, fmt.Sprintf("%s %s", c.Action, c.Path))
+	}
+
+	dirs := make([]string, 0, len(r.Directories))
+	for d := range r.Directories {
+		dirs = append(dirs, d)
+	}
+	sort.Strings(dirs)
+
+	lines = append(lines, "", "Changes by directory:")
+	for _, d := range dirs {
+		lines = append(lines, fmt.Sprintf("  %s: %s", d, r.Directories[d]))
+	}
+
+	lines = append(lines, fmt.Sprintf("Total: %s", r.Total))
+
+	for _, l := range lines {
+		if _, err := fmt.Fprintln(w, l); err != nil {
+			return errors.Wrap(err, "writing line")
+		}
+	}
+
+	return nil
+}
+
+func (c changeCounts) String() string {
+	return fmt.Sprintf("%d added, %d deleted, %d modified", c.Added, c.Deleted, c.Modified)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Changed files", func() {
+	output := []string{
+		"Local and Remote metadata are synchronized, no sync needed.",
+		"Last full backup date: Mon Oct  9 02:00:01 2023",
+		"M .",
+		"A data/new.txt",
+		"M data/myapp/config.yml",
+		"D data/myapp/old file.yml",
+		"D toplevel.txt",
+		"--------------[ Backup Statistics ]--------------",
+		"StartTime 1696896001.12 (Tue Oct 10 02:00:01 2023)",
+		"SourceFiles 10",
+		"NewFiles 1",
+		"DeletedFiles 2",
+		"ChangedFiles 1",
+		"Errors 0",
+		"-------------------------------------------------",
+	}
+
+	It("should parse changes and statistics", func() {
+		report := parseChangedFiles(output)
+
+		Expect(report.Changes).To(Equal([]fileChange{
+			{Action: "A", Path: "data/new.txt"},
+			{Action: "M", Path: "data/myapp/config.yml"},
+			{Action: "D", Path: "data/myapp/old file.yml"},
+			{Action: "D", Path: "toplevel.txt"},
+		}))
+		Expect(report.Total).To(Equal(changeCounts{Added: 1, Deleted: 2, Modified: 1}))
+		Expect(report.Directories).To(Equal(map[string]*changeCounts{
+			"data": {Added: 1, Deleted: 1, Modified: 1},
+			".":    {Deleted: 1},
+		}))
+		Expect(report.SourceFiles).To(Equal(10))
+		Expect(report.previousFiles()).To(Equal(11))
+	})
+
+	It("should report guard violations", func() {
+		cf := &configFile{}
+		cf.ChangeGuard.MaxDeletedRatio = 0.1
+		cf.ChangeGuard.MaxModifiedRatio = 0.5
+		cf.ChangeGuard.SuspiciousExtensions = []string{"TXT", ".locked"}
+
+		Expect(cf.changeGuardViolations(parseChangedFiles(output))).To(Equal([]string{
+			"2 of 11 files deleted (18.2%, threshold 10.0%)",
+			"1 files with suspicious extensions (threshold 0)",
+		}))
+	})
+
+	It("should not check ratios without statistics", func() {
+		cf := &configFile{}
+		cf.ChangeGuard.MaxDeletedRatio = 0.1
+
+		Expect(cf.changeGuardViolations(parseChangedFiles(output[:7]))).To(BeEmpty())
+	})
+})
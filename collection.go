@@ -0,0 +1,63 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var backupSetLine = regexp.MustCompile(`^\s*(Full|Incremental)\s+(\w{3} \w{3} [ \d]\d \d{2}:\d{2}:\d{2} \d{4})\s+(\d+)\s*$`)
+
+type backupSet struct {
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+	Volumes int       `json:"volumes"`
+}
+
+// duplicityTime formats the time of the backup set to be passed to the
+// --time parameter of duplicity
+func (b backupSet) duplicityTime() string {
+	return b.Time.Format(time.RFC3339)
+}
+
+// listBackupSets retrieves all backup sets from the collection-status
+// of the backup, ordered by their time
+func (c *configFile) listBackupSets() ([]backupSet, error) {
+	var lines []string
+
+	if err := runDuplicity(c, []string{commandStatus}, "", func(l string) {
+		lines = append(lines, l)
+	}); err != nil {
+		return nil, errors.Wrap(err, "fetching collection-status")
+	}
+
+	return parseCollectionStatus(lines), nil
+}
+
+// parseCollectionStatus extracts the backup sets of all chains listed
+// in the output of the collection-status command
+func parseCollectionStatus(lines []string) []backupSet {
+	var sets []backupSet
+
+	for _, l := range lines {
+		match := backupSetLine.FindStringSubmatch(l)
+		if match == nil {
+			continue
+		}
+
+		setTime, err := time.ParseInLocation(duplicityTimeFormat, match[2], time.Local)
+		if err != nil {
+			continue
+		}
+
+		volumes, _ := strconv.Atoi(match[3]) // #nosec G104 // Regex ensures this is a number
+
+		sets = append(sets, backupSet{Type: match[1], Time: setTime, Volumes: volumes})
+	}
+
+	sort.Slice(sets, func(i, j int) bool { return sets[i].Time.Before(sets[j].Time) })
+	return sets
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Collection status", func() {
+	output := []string{
+		"Last full backup date: Mon Oct  9 02:00:01 2023",
+		"Collection Status",
+		"-----------------",
+		"Found 1 secondary backup chain(s).",
+		"Secondary chain 1 of 1:",
+		"-------------------------",
+		"Chain start time: Sun Oct  1 02:00:01 2023",
+		"Chain end time: Sun Oct  1 02:00:01 2023",
+		"Number of contained backup sets: 1",
+		"Total number of contained volumes: 4",
+		" Type of backup set:                            Time:      Num volumes:",
+		"                Full         Sun Oct  1 02:00:01 2023                 4",
+		"-------------------------",
+		"Found primary backup chain with matching signature chain:",
+		"-------------------------",
+		"Chain start time: Mon Oct  9 02:00:01 2023",
+		"Chain end time: Tue Oct 10 02:00:01 2023",
+		"Number of contained backup sets: 2",
+		"Total number of contained volumes: 3",
+		" Type of backup set:                            Time:      Num volumes:",
+		"                Full         Mon Oct  9 02:00:01 2023                 2",
+		"         Incremental         Tue Oct 10 02:00:01 2023                 1",
+		"-------------------------",
+		"No orphaned or incomplete backup sets found.",
+	}
+
+	It("should parse the backup sets of all chains", func() {
+		Expect(parseCollectionStatus(output)).To(Equal([]backupSet{
+			{Type: "Full", Time: time.Date(2023, time.October, 1, 2, 0, 1, 0, time.Local), Volumes: 4},
+			{Type: "Full", Time: time.Date(2023, time.October, 9, 2, 0, 1, 0, time.Local), Volumes: 2},
+			{Type: "Incremental", Time: time.Date(2023, time.October, 10, 2, 0, 1, 0, time.Local), Volumes: 1},
+		}))
+	})
+})
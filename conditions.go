@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Luzifer/go_helpers/v2/str"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	conditionRetryInterval = time.Minute
+	conditionCheckTimeout  = 10 * time.Second
+
+	powerSupplyDir = "/sys/class/power_supply"
+	loadAvgFile    = "/proc/loadavg"
+
+	bytesPerMB = 1024 * 1024
+)
+
+// destinationPorts are used to check the reachability of destinations
+// without an explicit port
+var destinationPorts = map[string]string{
+	"ftp":     "21",
+	"ftps":    "21",
+	"http":    "80",
+	"https":   "443",
+	"rsync":   "22",
+	"s3":      "443",
+	"scp":     "22",
+	"sftp":    "22",
+	"ssh":     "22",
+	"webdav":  "80",
+	"webdavs": "443",
+}
+
+type conditionsConfig struct {
+	Commands             []string      `yaml:"commands"`
+	SkipOnBattery        bool          `yaml:"skip_on_battery"`
+	SkipOnMetered        bool          `yaml:"skip_on_metered"`
+	MinFreeSpaceMB       uint64        `yaml:"min_free_space_mb"`
+	FreeSpacePaths       []string      `yaml:"free_space_paths"`
+	DestinationReachable bool          `yaml:"destination_reachable"`
+	ReachableAddress     string        `yaml:"reachable_address"`
+	MaxLoad              float64       `yaml:"max_load"`
+	Wait                 time.Duration `yaml:"wait"`
+}
+
+func (c *configFile) validateConditions() error {
+	if c.Conditions.MaxLoad > 0 && runtime.GOOS != "linux" {
+		return errors.New("max_load is only supported on linux")
+	}
+
+	if c.Conditions.DestinationReachable {
+		if _, err := c.reachableAddress(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkConditions ensures the configured preconditions of the command
+// are met. Unmet conditions are rechecked until the wait time is
+// exceeded, afterwards the run is skipped.
+func (c *configFile) checkConditions(command string) error {
+	commands := c.Conditions.Commands
+	if len(commands) == 0 {
+		commands = backupCommands
+	}
+
+	if !str.StringInSlice(command, commands) {
+		return nil
+	}
+
+	deadline := time.Now().Add(c.Conditions.Wait)
+
+	for {
+		reason, err := c.unmetCondition()
+		if err != nil {
+			return errors.Wrap(err, "checking conditions")
+		}
+
+		if reason == "" {
+			return nil
+		}
+
+		if time.Now().Add(conditionRetryInterval).After(deadline) {
+			return exitCodeError{code: exitCodeConditions, err: skippedError{reason: reason}}
+		}
+
+		logrus.Infof("Deferring run: %s", reason)
+		select {
+		case <-interruptCtx.Done():
+			return errors.Wrap(interruptError(), "waiting for conditions")
+		case <-time.After(conditionRetryInterval):
+		}
+	}
+}
+
+// unmetCondition returns the reason for the first condition not being
+// met or an empty string if all conditions are met
+func (c *configFile) unmetCondition() (string, error) {
+	cond := c.Conditions
+
+	if cond.SkipOnBattery && onBatteryPower() {
+		return "running on battery power", nil
+	}
+
+	if cond.SkipOnMetered {
+		metered, err := onMeteredNetwork()
+		if err != nil {
+			return "", err
+		}
+		if metered {
+			return "connected to a metered network", nil
+		}
+	}
+
+	if cond.MinFreeSpaceMB > 0 {
+		for _, p := range c.freeSpacePaths() {
+			free, err := freeSpace(existingParent(p))
+			if err != nil {
+				return "", errors.Wrapf(err, "getting free space of %s", p)
+			}
+
+			if free/bytesPerMB < cond.MinFreeSpaceMB {
+				return fmt.Sprintf("only %d MB free in %s", free/bytesPerMB, p), nil
+			}
+		}
+	}
+
+	if cond.DestinationReachable {
+		addr, err := c.reachableAddress()
+		if err != nil {
+			return "", err
+		}
+
+		conn, err := net.DialTimeout("tcp", addr, conditionCheckTimeout)
+		if err != nil {
+			return fmt.Sprintf("destination %s is not reachable: %s", addr, err), nil
+		}
+		conn.Close() //nolint:errcheck,gosec // Connection was only used to check reachability
+	}
+
+	if cond.MaxLoad > 0 {
+		load, err := loadAverage()
+		if err != nil {
+			return "", err
+		}
+		if load > cond.MaxLoad {
+			return fmt.Sprintf("load average %.2f exceeds the maximum of %v", load, cond.MaxLoad), nil
+		}
+	}
+
+	return "", nil
+}
+
+// onBatteryPower reports whether no external power supply is online
+// while a battery is discharging
+func onBatteryPower() bool {
+	supplies, _ := filepath.Glob(filepath.Join(powerSupplyDir, "*")) // #nosec G104 // Pattern is static and valid
+
+	var discharging bool
+	for _, s := range supplies {
+		switch readSysValue(s, "type") {
+		case "Mains", "USB":
+			if readSysValue(s, "online") == "1" {
+				return false
+			}
+
+		case "Battery":
+			if readSysValue(s, "status") == "Discharging" {
+				discharging = true
+			}
+		}
+	}
+
+	return discharging
+}
+
+func readSysValue(dir, name string) string {
+	v, err := os.ReadFile(filepath.Join(dir, name)) //#nosec:G304 // Reading sysfs attributes
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(v))
+}
+
+// onMeteredNetwork asks NetworkManager whether one of the devices is
+// connected using a connection marked or guessed as metered
+func onMeteredNetwork() (bool, error) {
+	ctx, cancel := context.WithTimeout(interruptCtx, conditionCheckTimeout)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, "nmcli", "-t", "-f", "GENERAL.METERED", "device", "show").Output()
+	if err != nil {
+		return false, errors.Wrap(err, "getting metered state from nmcli")
+	}
+
+	for _, l := range bytes.Split(out, []byte("\n")) {
+		if bytes.HasPrefix(bytes.TrimPrefix(l, []byte("GENERAL.METERED:")), []byte("yes")) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// freeSpacePaths returns the configured paths or the temp and archive
+// dir used by duplicity
+func (c *configFile) freeSpacePaths() []string {
+	if len(c.Conditions.FreeSpacePaths) > 0 {
+		return c.Conditions.FreeSpacePaths
+	}
+
+	tempDir := c.staticOption("--tempdir")
+	if tempDir == "" {
+		tempDir = os.TempDir()
+	}
+
+	paths := []string{tempDir}
+
+	archiveDir := c.staticOption("--archive-dir")
+	if archiveDir == "" {
+		if cacheDir, err := os.UserCacheDir(); err == nil {
+			archiveDir = filepath.Join(cacheDir, "duplicity")
+		}
+	}
+
+	if archiveDir != "" {
+		paths = str.AppendIfMissing(paths, archiveDir)
+	}
+
+	return paths
+}
+
+// staticOption returns the value of the option in the static_options
+func (c *configFile) staticOption(name string) string {
+	for i, o := range c.StaticBackupOptions {
+		if v, ok := strings.CutPrefix(o, name+"="); ok {
+			return v
+		}
+
+		if o == name && i+1 < len(c.StaticBackupOptions) {
+			return c.StaticBackupOptions[i+1]
+		}
+	}
+
+	return ""
+}
+
+// existingParent returns the path or its closest existing parent as
+// the archive dir might not yet be created
+func existingParent(p string) string {
+	for {
+		if _, err := os.Stat(p); err == nil || filepath.Dir(p) == p {
+			return p
+		}
+		p = filepath.Dir(p)
+	}
+}
+
+// reachableAddress returns the configured address or derives the
+// address to check from the destination
+func (c *configFile) reachableAddress() (string, error) {
+	if c.Conditions.ReachableAddress != "" {
+		return c.Conditions.ReachableAddress, nil
+	}
+
+	u, err := url.Parse(c.Destination)
+	if err != nil {
+		return "", errors.Wrap(err, "parsing destination")
+	}
+
+	switch u.Scheme {
+	case "s3+http", "boto3+s3":
+		// Host of these destinations is the bucket
+		u, _ = url.Parse(defaultS3Endpoint) // #nosec G104 // Constant is a valid URL
+	case "gs":
+		return "storage.googleapis.com:443", nil
+	}
+
+	// Backends like pexpect+sftp are prefixed
+	scheme := u.Scheme[strings.LastIndex(u.Scheme, "+")+1:]
+
+	port, ok := destinationPorts[scheme]
+	if !ok || u.Hostname() == "" {
+		return "", errors.Errorf("cannot derive address to check from %q destination, configure reachable_address", u.Scheme)
+	}
+
+	if u.Port() != "" {
+		port = u.Port()
+	}
+
+	return net.JoinHostPort(u.Hostname(), port), nil
+}
+
+func loadAverage() (float64, error) {
+	content, err := os.ReadFile(loadAvgFile)
+	if err != nil {
+		return 0, errors.Wrap(err, "reading load average")
+	}
+
+	fields := strings.Fields(string(content))
+	if len(fields) == 0 {
+		return 0, errors.New("load average is empty")
+	}
+
+	load, err := strconv.ParseFloat(fields[0], 64)
+	return load, errors.Wrap(err, "parsing load average")
+}
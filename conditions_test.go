@@ -0,0 +1,46 @@
+package main
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+)
+
+var _ = Describe("Conditions", func() {
+	It("should derive the address to check from the destination", func() {
+		for dest, addr := range map[string]string{
+			"sftp://user@backup.example.com/backups":  "backup.example.com:22",
+			"pexpect+scp://backup.example.com:2222/x": "backup.example.com:2222",
+			"s3://minio.example.com/bucket/prefix":    "minio.example.com:443",
+			"s3+http://bucket/prefix":                 "s3.amazonaws.com:443",
+			"webdavs://dav.example.com/backups":       "dav.example.com:443",
+		} {
+			c := &configFile{Destination: dest}
+			Expect(c.reachableAddress()).To(Equal(addr), dest)
+		}
+
+		_, err := (&configFile{Destination: "file:///mnt/backup"}).reachableAddress()
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should read options from the static options", func() {
+		c := &configFile{StaticBackupOptions: []string{"--tempdir", "/var/tmp", "--archive-dir=/srv/cache"}}
+		Expect(c.staticOption("--tempdir")).To(Equal("/var/tmp"))
+		Expect(c.staticOption("--archive-dir")).To(Equal("/srv/cache"))
+		Expect(c.freeSpacePaths()).To(Equal([]string{"/var/tmp", "/srv/cache"}))
+	})
+
+	It("should skip backups when conditions are not met", func() {
+		c := &configFile{StaticBackupOptions: []string{"--tempdir", "/tmp", "--archive-dir", "/tmp"}}
+		c.Conditions.MinFreeSpaceMB = 1 << 40
+		c.Conditions.Wait = time.Second
+
+		err := c.checkConditions(commandBackup)
+		Expect(errors.As(err, new(skippedError))).To(BeTrue())
+		Expect(exitCode(err)).To(Equal(exitCodeConditions))
+
+		Expect(c.checkConditions(commandStatus)).To(Succeed())
+	})
+})
@@ -5,10 +5,13 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path"
 	"regexp"
 	"strconv"
 	"text/template"
+	"time"
 
+	"github.com/Luzifer/go_helpers/v2/str"
 	valid "github.com/asaskevich/govalidator"
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v2"
@@ -24,15 +27,31 @@ const (
 	commandStatus           = "status"
 	commandVerify           = "verify"
 	commandRemove           = "__remove_old"
+	commandRestorePaths     = "__restore_paths"
 	commandListChangedFiles = "list-changed-files"
+	commandRestoreTest      = "restore-test"
+	commandCheckCanary      = "check-canary"
+	commandBrowse           = "browse"
+	commandHistory          = "history"
+	commandFind             = "find"
+	commandUpdateIndex      = "update-index"
+	commandDiff             = "diff"
+	commandLock             = "lock"
 )
 
 var (
+	backupCommands = []string{
+		commandBackup,
+		commandFullBackup,
+		commandIncrBackup,
+	}
 	notifyCommands = []string{
 		commandBackup,
 		commandRemove,
 		commandFullBackup,
 		commandIncrBackup,
+		commandRestoreTest,
+		commandCheckCanary,
 	}
 	removeCommands = []string{
 		commandBackup,
@@ -48,6 +67,7 @@ type configFile struct {
 	AWS         struct {
 		AccessKeyID     string `yaml:"access_key_id"`
 		SecretAccessKey string `yaml:"secret_access_key"`
+		SessionToken    string `yaml:"session_token"`
 		StorageClass    string `yaml:"storage_class"`
 	} `yaml:"aws"`
 	GoogleCloud struct {
@@ -60,10 +80,12 @@ type configFile struct {
 		AuthURL     string `yaml:"auth_url"`
 		AuthVersion int    `yaml:"auth_version"`
 	} `yaml:"swift"`
-	Include            []string `yaml:"inclist"`
-	Exclude            []string `yaml:"exclist"`
-	IncExcFile         string   `yaml:"incexcfile" valid:"customFileExistsValidator"`
-	ExcludeDeviceFiles bool     `yaml:"excdevicefiles"`
+	Sources            []sourceConfig `yaml:"sources"`
+	DumpDirectory      string         `yaml:"dump_dir"`
+	Include            []string       `yaml:"inclist"`
+	Exclude            []string       `yaml:"exclist"`
+	IncExcFile         string         `yaml:"incexcfile" valid:"customFileExistsValidator"`
+	ExcludeDeviceFiles bool           `yaml:"excdevicefiles"`
 	Encryption         struct {
 		Enable           bool   `yaml:"enable"`
 		Passphrase       string `yaml:"passphrase"`
@@ -72,12 +94,46 @@ type configFile struct {
 		HideKeyID        bool   `yaml:"hide_key_id"`
 		SecretKeyRing    string `yaml:"secret_keyring"`
 	} `yaml:"encryption"`
-	StaticBackupOptions []string `yaml:"static_options"`
+	StaticBackupOptions []string         `yaml:"static_options"`
+	Throttle            throttleConfig   `yaml:"throttle"`
+	Snapshot            snapshotConfig   `yaml:"snapshot"`
+	Conditions          conditionsConfig `yaml:"conditions"`
+	RemoteLock          remoteLockConfig `yaml:"remote_lock"`
 	Cleanup             struct {
 		Type  string `yaml:"type"`
 		Value string `yaml:"value"`
 	} `yaml:"cleanup"`
-	LogDirectory  string `yaml:"logdir" valid:"required"`
+	Hooks    map[string]commandHooks `yaml:"hooks"`
+	Timeouts struct {
+		Commands map[string]time.Duration `yaml:"commands"`
+		NoOutput time.Duration            `yaml:"no_output"`
+	} `yaml:"timeouts"`
+	ChangeGuard struct {
+		MaxDeletedRatio      float64  `yaml:"max_deleted_ratio"`
+		MaxModifiedRatio     float64  `yaml:"max_modified_ratio"`
+		SuspiciousExtensions []string `yaml:"suspicious_extensions"`
+		MaxSuspiciousFiles   int      `yaml:"max_suspicious_files"`
+	} `yaml:"change_guard"`
+	Canary struct {
+		Enable            bool   `yaml:"enable"`
+		Path              string `yaml:"path"`
+		VerifyAfterBackup bool   `yaml:"verify_after_backup"`
+	} `yaml:"canary"`
+	Restore struct {
+		ConflictPolicy string `yaml:"conflict_policy"`
+	} `yaml:"restore"`
+	RestoreTest struct {
+		SampleSize  int      `yaml:"sample_size"`
+		CanaryPaths []string `yaml:"canary_paths"`
+		TempDir     string   `yaml:"temp_dir"`
+	} `yaml:"restore_test"`
+	CacheDirectory string `yaml:"cachedir"`
+	Index          struct {
+		UpdateAfterBackup *bool `yaml:"update_after_backup"`
+	} `yaml:"index"`
+	LogDirectory  string             `yaml:"logdir" valid:"required"`
+	LogRetention  logRetentionConfig `yaml:"log_retention"`
+	Logging       loggingConfig      `yaml:"logging"`
 	Notifications struct {
 		Slack struct {
 			HookURL  string `yaml:"hook_url"`
@@ -91,6 +147,10 @@ type configFile struct {
 			Freshness int64  `yaml:"freshness"`
 		} `yaml:"mondash"`
 	} `yaml:"notifications"`
+
+	activeSnapshot   *snapshot
+	activeRemoteLock *remoteLock
+	notifyFailed     bool
 }
 
 func init() {
@@ -118,6 +178,44 @@ func (c *configFile) validate() error {
 		return errors.New("Encryption is enabled but no encryption key or passphrase is specified")
 	}
 
+	if err := c.validateHooks(); err != nil {
+		return err
+	}
+
+	for _, s := range c.Sources {
+		if err := s.validate(); err != nil {
+			return errors.Wrap(err, "validating sources")
+		}
+	}
+
+	if err := c.Snapshot.validate(); err != nil {
+		return errors.Wrap(err, "validating snapshot")
+	}
+
+	if err := c.validateConditions(); err != nil {
+		return errors.Wrap(err, "validating conditions")
+	}
+
+	if err := c.Throttle.validate(); err != nil {
+		return errors.Wrap(err, "validating throttle")
+	}
+
+	for _, o := range c.Logging.Outputs {
+		if err := o.validate(); err != nil {
+			return errors.Wrap(err, "validating log outputs")
+		}
+	}
+
+	if c.RemoteLock.Enable {
+		if _, err := c.remoteLockBackend(); err != nil {
+			return errors.Wrap(err, "validating remote lock")
+		}
+	}
+
+	if c.Restore.ConflictPolicy != "" && !str.StringInSlice(c.Restore.ConflictPolicy, conflictPolicies) {
+		return errors.Errorf("Unknown restore conflict_policy %q", c.Restore.ConflictPolicy)
+	}
+
 	if c.Destination[0:2] == "s3" && (c.AWS.AccessKeyID == "" || c.AWS.SecretAccessKey == "") {
 		return errors.New("Destination is S3 but AWS credentials are not configured")
 	}
@@ -129,6 +227,20 @@ func (c *configFile) validate() error {
 	return nil
 }
 
+func (c *configFile) validateHooks() error {
+	for command, hooks := range c.Hooks {
+		for _, stage := range []string{hookStagePre, hookStagePost, hookStageOnSuccess, hookStageOnFailure} {
+			for _, h := range hooks.stage(stage) {
+				if err := h.validate(); err != nil {
+					return errors.Wrapf(err, "validating %s hooks of %s", stage, command)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
 func getTemplateFuncMap() template.FuncMap {
 	return template.FuncMap{
 		"env": func(name string, v ...string) string {
@@ -185,13 +297,13 @@ func (c *configFile) GenerateCommand(argv []string, time string) (commandLine []
 		option = "inc"
 		root = c.RootPath
 		dest = c.Destination
-		commandLine, env, err = c.generateFullCommand(option, time, root, dest, addTime, "")
+		commandLine, env, err = c.generateFullCommand(option, time, root, dest, addTime, "", nil)
 
 	case commandListChangedFiles:
 		option = "inc"
 		root = c.RootPath
 		dest = c.Destination
-		commandLine, env, err = c.generateFullCommand(option, time, root, dest, addTime, "")
+		commandLine, env, err = c.generateFullCommand(option, time, root, dest, addTime, "", nil)
 		commandLine = append([]string{"--dry-run", "--verbosity", "8"}, commandLine...)
 		logfilter = regexp.MustCompile(`^[ADM] `)
 
@@ -199,19 +311,20 @@ func (c *configFile) GenerateCommand(argv []string, time string) (commandLine []
 		option = command
 		root = c.RootPath
 		dest = c.Destination
-		commandLine, env, err = c.generateFullCommand(option, time, root, dest, addTime, "")
+		commandLine, env, err = c.generateFullCommand(option, time, root, dest, addTime, "", nil)
 
 	case commandIncrBackup:
 		option = command
 		root = c.RootPath
 		dest = c.Destination
-		commandLine, env, err = c.generateFullCommand(option, time, root, dest, addTime, "")
+		commandLine, env, err = c.generateFullCommand(option, time, root, dest, addTime, "", nil)
 
 	case commandCleanup:
 		option = command
 		commandLine, env, err = c.generateLiteCommand(option, time, addTime)
 
 	case commandList:
+		addTime = true
 		option = command
 		commandLine, env, err = c.generateLiteCommand(option, time, addTime)
 
@@ -234,7 +347,20 @@ func (c *configFile) GenerateCommand(argv []string, time string) (commandLine []
 			return commandLine, env, logfilter, err
 		}
 
-		commandLine, env, err = c.generateFullCommand(option, time, root, dest, addTime, restoreFile)
+		commandLine, env, err = c.generateFullCommand(option, time, root, dest, addTime, restoreFile, nil)
+
+	case commandRestorePaths:
+		// Restores the paths following the target in a single run
+		if len(argv) < 3 { //nolint:gomnd // Command, target and at least one path
+			err = errors.New("restore of paths requires a target and paths")
+			return commandLine, env, logfilter, err
+		}
+
+		addTime = true
+		option = commandRestore
+		root = c.Destination
+		dest = argv[1]
+		commandLine, env, err = c.generateFullCommand(option, time, root, dest, addTime, "", restoreSelection(dest, argv[2:]))
 
 	case commandStatus:
 		option = "collection-status"
@@ -244,7 +370,7 @@ func (c *configFile) GenerateCommand(argv []string, time string) (commandLine []
 		option = command
 		root = c.Destination
 		dest = c.RootPath
-		commandLine, env, err = c.generateFullCommand(option, time, root, dest, addTime, "")
+		commandLine, env, err = c.generateFullCommand(option, time, root, dest, addTime, "", nil)
 
 	case commandRemove:
 		commandLine, env, err = c.generateRemoveCommand()
@@ -283,6 +409,9 @@ func (c *configFile) generateCredentialExport() []string {
 		env = append(env, "AWS_ACCESS_KEY_ID="+c.AWS.AccessKeyID)
 		env = append(env, "AWS_SECRET_ACCESS_KEY="+c.AWS.SecretAccessKey)
 	}
+	if c.AWS.SessionToken != "" {
+		env = append(env, "AWS_SESSION_TOKEN="+c.AWS.SessionToken)
+	}
 	if c.GoogleCloud.AccessKeyID != "" {
 		env = append(env, "GS_ACCESS_KEY_ID="+c.GoogleCloud.AccessKeyID)
 		env = append(env, "GS_SECRET_ACCESS_KEY="+c.GoogleCloud.SecretAccessKey)
@@ -338,8 +467,11 @@ func (c *configFile) generateLiteCommand(option, time string, addTime bool) ([]s
 	return commandLine, env, nil
 }
 
+// generateFullCommand assembles the command for option. A selection
+// replaces the configured includes and excludes.
+//
 //revive:disable-next-line:flag-parameter // Keeping for the sake of simplicity
-func (c *configFile) generateFullCommand(option, time, root, dest string, addTime bool, restoreFile string) ([]string, []string, error) {
+func (c *configFile) generateFullCommand(option, time, root, dest string, addTime bool, restoreFile string, selection []string) ([]string, []string, error) {
 	var commandLine, env, tmpArg, tmpEnv []string
 	// Assemble command
 	commandLine = append(commandLine, option)
@@ -358,11 +490,15 @@ func (c *configFile) generateFullCommand(option, time, root, dest string, addTim
 	commandLine = append(commandLine, tmpArg...)
 	env = append(env, tmpEnv...)
 	// Includes / Excludes
-	tmpArg, tmpEnv = c.generateIncludeExclude()
+	if selection != nil {
+		tmpArg, tmpEnv = selection, nil
+	} else {
+		tmpArg, tmpEnv = c.generateIncludeExclude()
+	}
 	commandLine = append(commandLine, tmpArg...)
 	env = append(env, tmpEnv...)
-	// Source / Destination
-	commandLine = append(commandLine, root, dest)
+	// Source / Destination (pointing into the snapshot while one is active)
+	commandLine = append(commandLine, c.snapshotPath(root), c.snapshotPath(dest))
 
 	return commandLine, env, nil
 }
@@ -370,20 +506,30 @@ func (c *configFile) generateFullCommand(option, time, root, dest string, addTim
 func (c *configFile) generateIncludeExclude() ([]string, []string) {
 	var arguments, env []string
 
+	if c.Canary.Enable {
+		// Ensure the canary is neither excluded nor left out by the includes
+		arguments = append(arguments, "--include="+c.snapshotPath(path.Join(c.RootPath, c.canaryPath())))
+	}
+
+	if len(c.Sources) > 0 {
+		// Same applies to the database dumps
+		arguments = append(arguments, "--include="+c.snapshotPath(path.Join(c.RootPath, c.dumpDir())))
+	}
+
 	if c.ExcludeDeviceFiles {
 		arguments = append(arguments, "--exclude-device-files")
 	}
 
 	for _, exc := range c.Exclude {
-		arguments = append(arguments, "--exclude="+exc)
+		arguments = append(arguments, "--exclude="+c.snapshotPath(exc))
 	}
 
 	for _, inc := range c.Include {
-		arguments = append(arguments, "--include="+inc)
+		arguments = append(arguments, "--include="+c.snapshotPath(inc))
 	}
 
 	if c.IncExcFile != "" {
-		arguments = append(arguments, "--include-globbing-filelist", c.IncExcFile)
+		arguments = append(arguments, "--include-globbing-filelist", c.incExcFile())
 	}
 
 	if len(c.Include) > 0 || c.IncExcFile != "" {
@@ -2,6 +2,8 @@ package main
 
 import (
 	"bytes"
+	"os"
+	"path/filepath"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -213,6 +215,31 @@ logdir: /var/log/duplicity/
 		})
 	})
 
+	Context("list-current-files at a given time with given config", func() {
+		BeforeEach(func() {
+			argv = []string{"list-current-files"}
+			t = "2023-10-09T02:00:01Z"
+		})
+
+		AfterEach(func() {
+			t = ""
+		})
+
+		It("should not have errored", func() {
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should have generated the expected commandLine", func() {
+			Expect(commandLine).To(Equal([]string{
+				"list-current-files",
+				"--full-if-older-than", "7D",
+				"--s3-use-new-style",
+				"--time", "2023-10-09T02:00:01Z",
+				"s3+http://my-backup/myhost/",
+			}))
+		})
+	})
+
 	Context("status with given config", func() {
 		BeforeEach(func() {
 			argv = []string{"status"}
@@ -300,4 +327,102 @@ logdir: /var/log/duplicity/
 			}))
 		})
 	})
+
+	Context("restoring multiple paths with given config", func() {
+		BeforeEach(func() {
+			argv = []string{commandRestorePaths, "/tmp/staging/restore", "data/myapp", "data/other/file.txt"}
+		})
+
+		It("should select the paths instead of the configured includes", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(commandLine).To(Equal([]string{
+				"restore",
+				"--full-if-older-than", "7D",
+				"--s3-use-new-style",
+				"--include=/tmp/staging/restore/data/myapp",
+				"--include=/tmp/staging/restore/data/other/file.txt",
+				"--exclude=**",
+				"s3+http://my-backup/myhost/",
+				"/tmp/staging/restore",
+			}))
+		})
+	})
+})
+
+var _ = Describe("Configfile with active snapshot", func() {
+	var cf *configFile
+
+	BeforeEach(func() {
+		cf = &configFile{
+			RootPath:    "/home",
+			Destination: "file:///backup",
+			Include:     []string{"/home/data", "/srv/other"},
+			Exclude:     []string{"/home/data/tmp"},
+		}
+	})
+
+	It("should read a lvm snapshot from the mountpoint", func() {
+		cf.activeSnapshot = &snapshot{
+			config:   snapshotConfig{Type: snapshotTypeLVM, Mountpoint: "/mnt/snap"},
+			livePath: "/home",
+		}
+
+		commandLine, _, _, err := cf.GenerateCommand([]string{commandBackup}, "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(commandLine).To(Equal([]string{
+			"inc",
+			"--no-encryption",
+			"--exclude=/mnt/snap/data/tmp",
+			"--include=/mnt/snap/data",
+			"--include=/srv/other",
+			"--exclude=**",
+			"/mnt/snap", "file:///backup",
+		}))
+	})
+
+	It("should read a btrfs snapshot from the subvolume inside the mountpoint", func() {
+		cf.activeSnapshot = &snapshot{
+			config:   snapshotConfig{Type: snapshotTypeBtrfs, Mountpoint: "/mnt/snap"},
+			livePath: "/home",
+		}
+
+		commandLine, _, _, err := cf.GenerateCommand([]string{commandBackup}, "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(commandLine).To(Equal([]string{
+			"inc",
+			"--no-encryption",
+			"--exclude=/mnt/snap/duplicity-backup/data/tmp",
+			"--include=/mnt/snap/duplicity-backup/data",
+			"--include=/srv/other",
+			"--exclude=**",
+			"/mnt/snap/duplicity-backup", "file:///backup",
+		}))
+	})
+
+	It("should rewrite the include / exclude file into the snapshot", func() {
+		tmp, err := os.MkdirTemp("", "duplicity-backup-test-")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(tmp) //nolint:errcheck // Test cleanup
+
+		cf.Include = nil
+		cf.Exclude = nil
+		cf.IncExcFile = filepath.Join(tmp, "filelist")
+		Expect(os.WriteFile(cf.IncExcFile, []byte("- /home/data/tmp\n+ /home/data/\n**/cache\n/home/*/docs\n"), 0o600)).To(Succeed())
+
+		cf.activeSnapshot = &snapshot{
+			config:   snapshotConfig{Type: snapshotTypeLVM, Mountpoint: "/mnt/snap"},
+			livePath: "/home",
+		}
+		Expect(cf.rewriteIncExcFile()).To(Succeed())
+		defer cf.activeSnapshot.teardown()
+
+		commandLine, _, _, err := cf.GenerateCommand([]string{commandBackup}, "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(commandLine).To(ContainElement(cf.activeSnapshot.filelist))
+		Expect(commandLine).NotTo(ContainElement(cf.IncExcFile))
+
+		content, err := os.ReadFile(cf.activeSnapshot.filelist)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(content)).To(Equal("- /mnt/snap/data/tmp\n+ /mnt/snap/data/\n**/cache\n/mnt/snap/*/docs\n"))
+	})
 })
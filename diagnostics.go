@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+type (
+	// diagnosis describes the recognised cause of a failure and how to
+	// resolve it
+	diagnosis struct {
+		Cause string
+		Hint  string
+	}
+
+	failureSignature struct {
+		pattern *regexp.Regexp
+		diagnosis
+	}
+)
+
+// failureSignatures are checked in order of their relevance as a single
+// failure might match multiple signatures
+var failureSignatures = []failureSignature{
+	{
+		regexp.MustCompile(`(?i)bad passphrase|bad session key|decryption failed: (bad key|wrong key)`),
+		diagnosis{
+			"GPG passphrase is wrong",
+			"Check the encryption passphrase in the config, it needs to match the one used for the existing backups",
+		},
+	},
+	{
+		regexp.MustCompile(`(?i)no secret key|no public key|public key not found|unusable public key|secret key not available`),
+		diagnosis{
+			"GPG key is missing in the keyring",
+			"Import the keys configured as gpg_encryption_key / gpg_sign_key (gpg --import) or configure the secret_keyring",
+		},
+	},
+	{
+		regexp.MustCompile(`NoSuchBucket`),
+		diagnosis{
+			"S3 bucket does not exist",
+			"Create the bucket or fix the bucket name in the dest",
+		},
+	},
+	{
+		regexp.MustCompile(`(?i)403 Forbidden|AccessDenied|InvalidAccessKeyId|SignatureDoesNotMatch`),
+		diagnosis{
+			"Access to the S3 bucket was denied",
+			"Check the aws access_key_id / secret_access_key and the permissions of the key on the bucket",
+		},
+	},
+	{
+		regexp.MustCompile(`(?i)no space left on device|\[Errno 28\]`),
+		diagnosis{
+			"Disk is full",
+			"Free space in the temp dir ($TMPDIR) and the duplicity archive dir (~/.cache/duplicity) or move them using --tempdir / --archive-dir in the static_options",
+		},
+	},
+	{
+		regexp.MustCompile(`(?i)old signatures not found`),
+		diagnosis{
+			"Signatures of the previous backups are missing in the archive dir and at the destination",
+			"Start a new backup chain using the full command",
+		},
+	},
+	{
+		regexp.MustCompile(`(?i)another (duplicity )?instance is already running|lockfile\.lock|AlreadyLocked`),
+		diagnosis{
+			"Archive dir is locked by another duplicity process",
+			"Wait for the other process to finish, if none is running remove the lockfile.lock in the duplicity archive dir (~/.cache/duplicity)",
+		},
+	},
+	{
+		regexp.MustCompile(`(?i)timed out|connection (refused|reset)|temporary failure in name resolution|name or service not known|network is unreachable|no route to host`),
+		diagnosis{
+			"Destination is not reachable",
+			"Check the network connection and the host of the dest, retries can be configured using --num-retries in the static_options",
+		},
+	},
+}
+
+func (d diagnosis) String() string {
+	return fmt.Sprintf("Cause: %s\nHint: %s", d.Cause, d.Hint)
+}
+
+// diagnose returns the diagnoses for failure signatures found in the
+// output of duplicity
+func diagnose(lines []string) []diagnosis {
+	var diagnoses []diagnosis
+
+	for _, sig := range failureSignatures {
+		for _, l := range lines {
+			if sig.pattern.MatchString(l) {
+				diagnoses = append(diagnoses, sig.diagnosis)
+				break
+			}
+		}
+	}
+
+	return diagnoses
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Failure diagnostics", func() {
+	causes := func(lines ...string) []string {
+		var out []string
+		for _, d := range diagnose(lines) {
+			out = append(out, d.Cause)
+		}
+		return out
+	}
+
+	It("should recognise known failure signatures", func() {
+		Expect(causes(
+			"GPGError: GPG Failed, see log below:",
+			"===== Begin GnuPG log =====",
+			"gpg: decryption failed: Bad session key",
+		)).To(Equal([]string{"GPG passphrase is wrong"}))
+
+		Expect(causes(
+			"Attempt 1 failed. ClientError: An error occurred (NoSuchBucket) when calling the PutObject operation",
+		)).To(Equal([]string{"S3 bucket does not exist"}))
+
+		Expect(causes(
+			"IOError: [Errno 28] No space left on device",
+		)).To(Equal([]string{"Disk is full"}))
+
+		Expect(causes(
+			"Attempt 1 failed. error: [Errno 110] Connection timed out",
+			"Giving up after 5 attempts.",
+		)).To(Equal([]string{"Destination is not reachable"}))
+	})
+
+	It("should not diagnose unknown failures", func() {
+		Expect(diagnose([]string{"Something unexpected happened"})).To(BeEmpty())
+	})
+})
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	outputFormatJSON = "json"
+	outputFormatText = "text"
+)
+
+var relativeTimeFormat = regexp.MustCompile(`^(\d+)([smhDWMY])$`)
+
+type (
+	backupDiff struct {
+		From     time.Time         `json:"from"`
+		To       time.Time         `json:"to"`
+		Added    []backupFile      `json:"added"`
+		Removed  []backupFile      `json:"removed"`
+		Modified []backupFileDelta `json:"modified"`
+	}
+
+	backupFileDelta struct {
+		Path       string    `json:"path"`
+		OldModTime time.Time `json:"old_mtime"`
+		NewModTime time.Time `json:"new_mtime"`
+	}
+)
+
+// runDiff compares the file listings of the backups at the times given
+// through --from and --to (defaulting to the latest backup)
+func runDiff(config *configFile) error {
+	diff, err := config.diffBackups(cfg.DiffFrom, cfg.DiffTo)
+	if err != nil {
+		logrus.WithError(err).Error("comparing backups")
+		return err
+	}
+
+	switch cfg.OutputFormat {
+	case outputFormatJSON:
+		err = json.NewEncoder(os.Stdout).Encode(diff)
+	case outputFormatText:
+		err = diff.writeText(os.Stdout)
+	default:
+		err = errors.Errorf("unsupported output format %q", cfg.OutputFormat)
+	}
+
+	if err != nil {
+		logrus.WithError(err).Error("writing diff")
+	}
+
+	return errors.Wrap(err, "writing diff")
+}
+
+func (c *configFile) diffBackups(from, to string) (*backupDiff, error) {
+	if from == "" {
+		return nil, errors.New("You need to specify the backup to compare from using --from: See help message")
+	}
+
+	sets, err := c.listBackupSets()
+	if err != nil {
+		return nil, errors.Wrap(err, "listing backup sets")
+	}
+
+	fromSet, err := findBackupSet(sets, from, time.Now())
+	if err != nil {
+		return nil, errors.Wrap(err, "finding --from backup")
+	}
+
+	toSet, err := findBackupSet(sets, to, time.Now())
+	if err != nil {
+		return nil, errors.Wrap(err, "finding --to backup")
+	}
+
+	fromFiles, err := c.cachedFileList(fromSet)
+	if err != nil {
+		return nil, errors.Wrap(err, "listing files of --from backup")
+	}
+
+	toFiles, err := c.cachedFileList(toSet)
+	if err != nil {
+		return nil, errors.Wrap(err, "listing files of --to backup")
+	}
+
+	return compareFileLists(fromSet, toSet, fromFiles, toFiles), nil
+}
+
+// findBackupSet returns the latest set created at or before the given
+// time. An empty time selects the latest set.
+func findBackupSet(sets []backupSet, t string, now time.Time) (backupSet, error) {
+	if len(sets) == 0 {
+		return backupSet{}, errors.New("no backups found")
+	}
+
+	if t == "" {
+		return sets[len(sets)-1], nil
+	}
+
+	at, err := parseBackupTime(t, now)
+	if err != nil {
+		return backupSet{}, err
+	}
+
+	for i := len(sets) - 1; i >= 0; i-- {
+		if !sets[i].Time.After(at) {
+			return sets[i], nil
+		}
+	}
+
+	return backupSet{}, errors.Errorf("no backup found at or before %s", at)
+}
+
+// parseBackupTime understands absolute times and the intervals
+// duplicity supports (e.g. 3D for three days ago)
+func parseBackupTime(t string, now time.Time) (time.Time, error) {
+	if t == "now" {
+		return now, nil
+	}
+
+	if m := relativeTimeFormat.FindStringSubmatch(t); m != nil {
+		n, _ := strconv.Atoi(m[1]) // #nosec G104 // Regex ensures this is a number
+
+		switch m[2] {
+		case "s":
+			return now.Add(-time.Duration(n) * time.Second), nil
+		case "m":
+			return now.Add(-time.Duration(n) * time.Minute), nil
+		case "h":
+			return now.Add(-time.Duration(n) * time.Hour), nil
+		case "D":
+			return now.AddDate(0, 0, -n), nil
+		case "W":
+			return now.AddDate(0, 0, -7*n), nil //nolint:gomnd // Days per week
+		case "M":
+			return now.AddDate(0, -n, 0), nil
+		case "Y":
+			return now.AddDate(-n, 0, 0), nil
+		}
+	}
+
+	if parsed, err := time.Parse(time.RFC3339, t); err == nil {
+		return parsed, nil
+	}
+
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"} {
+		if parsed, err := time.ParseInLocation(layout, t, time.Local); err == nil {
+			if layout == "2006-01-02" {
+				// A day includes all backups made on it
+				parsed = parsed.AddDate(0, 0, 1).Add(-time.Second)
+			}
+			return parsed, nil
+		}
+	}
+
+	return time.Time{}, errors.Errorf("unable to parse time %q", t)
+}
+
+// compareFileLists detects modifications by the modification time
+func compareFileLists(fromSet, toSet backupSet, fromFiles, toFiles []backupFile) *backupDiff {
+	diff := &backupDiff{
+		From:     fromSet.Time,
+		To:       toSet.Time,
+		Added:    []backupFile{},
+		Removed:  []backupFile{},
+		Modified: []backupFileDelta{},
+	}
+
+	old := map[string]backupFile{}
+	for _, f := range fromFiles {
+		old[f.Path] = f
+	}
+
+	for _, f := range toFiles {
+		o, ok := old[f.Path]
+		delete(old, f.Path)
+
+		switch {
+		case !ok:
+			diff.Added = append(diff.Added, f)
+		case !o.ModTime.Equal(f.ModTime):
+			diff.Modified = append(diff.Modified, backupFileDelta{Path: f.Path, OldModTime: o.ModTime, NewModTime: f.ModTime})
+		}
+	}
+
+	for _, f := range old {
+		diff.Removed = append(diff.Removed, f)
+	}
+	sort.Slice(diff.Removed, func(i, j int) bool { return diff.Removed[i].Path < diff.Removed[j].Path })
+
+	return diff
+}
+
+func (b backupDiff) writeText(w io.Writer) error {
+	lines := []string{fmt.Sprintf("Comparing backup %s to %s", b.From.Format(historyTimeFormat), b.To.Format(historyTimeFormat))}
+
+	for _, f := range b.Added {
+		lines = append(lines, fmt.Sprintf("A %s", f.Path))
+	}
+	for _, f := range b.Removed {
+		lines = append(lines, fmt.Sprintf("D %s", f.Path))
+	}
+	for _, f := range b.Modified {
+		lines = append(lines, fmt.Sprintf("M %s (%s -> %s)", f.Path, f.OldModTime.Format(historyTimeFormat), f.NewModTime.Format(historyTimeFormat)))
+	}
+
+	lines = append(lines, fmt.Sprintf("%d added, %d removed, %d modified", len(b.Added), len(b.Removed), len(b.Modified)))
+
+	for _, l := range lines {
+		if _, err := fmt.Fprintln(w, l); err != nil {
+			return errors.Wrap(err, "writing line")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Backup diff", func() {
+	var (
+		now  = time.Date(2023, time.October, 10, 12, 0, 0, 0, time.Local)
+		sets = []backupSet{
+			{Type: "Full", Time: time.Date(2023, time.October, 8, 2, 0, 0, 0, time.Local)},
+			{Type: "Incremental", Time: time.Date(2023, time.October, 9, 2, 0, 0, 0, time.Local)},
+			{Type: "Incremental", Time: time.Date(2023, time.October, 10, 2, 0, 0, 0, time.Local)},
+		}
+	)
+
+	It("should select the latest backup at or before the given time", func() {
+		for t, expected := range map[string]int{
+			"":                    2,
+			"now":                 2,
+			"1D":                  1,
+			"2023-10-09":          1,
+			"2023-10-09T01:59:59": 0,
+			"2023-10-08T02:00:00": 0,
+		} {
+			set, err := findBackupSet(sets, t, now)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(set).To(Equal(sets[expected]), t)
+		}
+
+		_, err := findBackupSet(sets, "2023-10-01", now)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should detect added, removed and modified files", func() {
+		var (
+			t1 = time.Date(2023, time.October, 7, 10, 0, 0, 0, time.Local)
+			t2 = time.Date(2023, time.October, 9, 10, 0, 0, 0, time.Local)
+		)
+
+		diff := compareFileLists(sets[0], sets[2],
+			[]backupFile{{Path: "a", ModTime: t1}, {Path: "b", ModTime: t1}, {Path: "c", ModTime: t1}},
+			[]backupFile{{Path: "a", ModTime: t1}, {Path: "c", ModTime: t2}, {Path: "d", ModTime: t2}},
+		)
+
+		Expect(diff.Added).To(Equal([]backupFile{{Path: "d", ModTime: t2}}))
+		Expect(diff.Removed).To(Equal([]backupFile{{Path: "b", ModTime: t1}}))
+		Expect(diff.Modified).To(Equal([]backupFileDelta{{Path: "c", OldModTime: t1, NewModTime: t2}}))
+	})
+})
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd
+
+package main
+
+import (
+	"runtime"
+
+	"github.com/pkg/errors"
+)
+
+func freeSpace(string) (uint64, error) {
+	return 0, errors.Errorf("checking free space is not supported on %s", runtime.GOOS)
+}
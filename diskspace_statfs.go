@@ -0,0 +1,20 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import (
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// freeSpace returns the bytes available to unprivileged users on the
+// filesystem containing the path
+func freeSpace(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, errors.Wrap(err, "getting filesystem stats")
+	}
+
+	return uint64(st.Bavail) * uint64(st.Bsize), nil //nolint:unconvert // Types differ between platforms
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os/exec"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// Exit codes of the wrapper itself. Failures of duplicity are reported
+// using the exit code of duplicity.
+const (
+	exitCodeSuccess      = 0
+	exitCodeFailure      = 1
+	exitCodeLockBusy     = 75 // EX_TEMPFAIL from sysexits.h
+	exitCodeConfig       = 78 // EX_CONFIG from sysexits.h
+	exitCodeCleanup      = 80
+	exitCodeNotification = 81
+	exitCodeLockLost     = 82
+	exitCodeConditions   = 83
+	exitCodeHook         = 84
+	exitCodeDump         = 85
+	exitCodeTimeout      = 124 // Same as timeout(1)
+	exitCodeInterrupted  = 128 // Signal number is added like shells do
+)
+
+// exitCodeError attaches the exit code to use to the error
+type exitCodeError struct {
+	code int
+	err  error
+}
+
+func (e exitCodeError) Error() string { return e.err.Error() }
+func (e exitCodeError) Unwrap() error { return e.err }
+
+// exitCode determines the exit code of the process for the error
+// returned by the command
+func exitCode(err error) int {
+	var (
+		codeErr exitCodeError
+		dupErr  duplicityError
+		execErr *exec.ExitError
+	)
+
+	if sig, ok := interruptSignal.Load().(syscall.Signal); ok {
+		return exitCodeInterrupted + int(sig)
+	}
+
+	switch {
+	case err == nil:
+		return exitCodeSuccess
+
+	case errors.As(err, &codeErr):
+		return codeErr.code
+
+	case errors.As(err, new(skippedError)):
+		return exitCodeLockBusy
+
+	case errors.As(err, new(remoteLockLostError)):
+		return exitCodeLockLost
+
+	case errors.As(err, new(timeoutError)):
+		return exitCodeTimeout
+
+	case errors.As(err, &dupErr) && errors.As(dupErr.err, &execErr) && execErr.ExitCode() > 0:
+		return execErr.ExitCode()
+
+	default:
+		return exitCodeFailure
+	}
+}
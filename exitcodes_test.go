@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os/exec"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+)
+
+var _ = Describe("Exit codes", func() {
+	exitErr := func(code string) error {
+		err := exec.Command("sh", "-c", "exit "+code).Run()
+		Expect(err).To(BeAssignableToTypeOf(&exec.ExitError{}))
+		return err
+	}
+
+	It("should map the errors to exit codes", func() {
+		for err, code := range map[error]int{
+			nil:                                 exitCodeSuccess,
+			errors.New("broken"):                exitCodeFailure,
+			skippedError{reason: "locked"}:      exitCodeLockBusy,
+			remoteLockLostError{reason: "lost"}: exitCodeLockLost,
+			timeoutError{}:                      exitCodeTimeout,
+			exitCodeError{code: exitCodeCleanup, err: errors.New("cleanup")}:                      exitCodeCleanup,
+			errors.Wrap(duplicityError{err: exitErr("23")}, "running duplicity"):                  23,
+			exitCodeError{code: exitCodeConditions, err: skippedError{reason: "on battery"}}:      exitCodeConditions,
+			errors.Wrap(exitCodeError{code: exitCodeDump, err: exitErr("3")}, "preparing backup"): exitCodeDump,
+		} {
+			Expect(exitCode(err)).To(Equal(code), "error %v", err)
+		}
+	})
+
+	It("should report duplicity killed by a signal as failure", func() {
+		err := exec.Command("sh", "-c", "kill -9 $$").Run()
+		Expect(err).To(BeAssignableToTypeOf(&exec.ExitError{}))
+
+		Expect(exitCode(duplicityError{err: err})).To(Equal(exitCodeFailure))
+	})
+
+	It("should not pass through exit codes of other commands", func() {
+		Expect(exitCode(errors.Wrap(exitErr("2"), "running command"))).To(Equal(exitCodeFailure))
+
+		c := configFile{Hooks: map[string]commandHooks{
+			commandBackup: {Pre: []hookConfig{{Command: []string{"sh", "-c", "exit 2"}}}},
+		}}
+		Expect(exitCode(c.runHooks(hookStagePre, hookRunInfo{Command: commandBackup}))).To(Equal(exitCodeHook))
+	})
+})
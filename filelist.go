@@ -0,0 +1,78 @@
+package main
+
+import (
+	"path"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// duplicityTimeFormat is the format duplicity uses to print times in
+// file listings and the collection status
+const duplicityTimeFormat = "Mon Jan _2 15:04:05 2006"
+
+type backupFile struct {
+	Path    string    `json:"path"`
+	ModTime time.Time `json:"mtime"`
+}
+
+// listFiles retrieves the files contained in the backup at the given
+// time (or the latest backup if no time is given)
+func (c *configFile) listFiles(restoreTime string) ([]backupFile, error) {
+	var lines []string
+
+	if err := runDuplicity(c, []string{commandList}, restoreTime, func(l string) {
+		lines = append(lines, l)
+	}); err != nil {
+		return nil, errors.Wrap(err, "listing files")
+	}
+
+	return parseFileList(lines), nil
+}
+
+// parseFileList extracts the files from the output of the
+// list-current-files command and ignores all other lines
+func parseFileList(lines []string) []backupFile {
+	var files []backupFile
+
+	for _, l := range lines {
+		if len(l) < len(duplicityTimeFormat)+2 || l[len(duplicityTimeFormat)] != ' ' {
+			continue
+		}
+
+		mtime, err := time.ParseInLocation(duplicityTimeFormat, l[:len(duplicityTimeFormat)], time.Local)
+		if err != nil {
+			continue
+		}
+
+		p := l[len(duplicityTimeFormat)+1:]
+		if p == "." {
+			// The root of the backup is listed too
+			continue
+		}
+
+		files = append(files, backupFile{Path: p, ModTime: mtime})
+	}
+
+	return files
+}
+
+// leafFiles removes all entries having children from the list which
+// leaves files, links and empty directories
+func leafFiles(files []backupFile) []backupFile {
+	parents := map[string]bool{}
+	for _, f := range files {
+		for d := path.Dir(f.Path); d != "." && d != "/" && !parents[d]; d = path.Dir(d) {
+			parents[d] = true
+		}
+	}
+
+	var out []backupFile
+	for _, f := range files {
+		if !parents[f.Path] {
+			out = append(out, f)
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Filelist", func() {
+	output := []string{
+		"Local and Remote metadata are synchronized, no sync needed.",
+		"Last full backup date: Mon Oct  9 02:00:01 2023",
+		"Mon Oct  9 01:59:12 2023 .",
+		"Mon Oct  9 01:58:00 2023 data",
+		"Sun Oct  8 12:00:00 2023 data/empty",
+		"Sun Oct  8 13:14:15 2023 data/myapp",
+		"Sun Oct  8 13:14:15 2023 data/myapp/config.yml",
+		"Sat Oct  7 09:08:07 2023 data/myapp/file with spaces.txt",
+	}
+
+	It("should parse all file entries", func() {
+		files := parseFileList(output)
+
+		Expect(files).To(HaveLen(5))
+		Expect(files[3].Path).To(Equal("data/myapp/config.yml"))
+		Expect(files[3].ModTime).To(Equal(time.Date(2023, time.October, 8, 13, 14, 15, 0, time.Local)))
+		Expect(files[4].Path).To(Equal("data/myapp/file with spaces.txt"))
+	})
+
+	It("should only return leaf entries", func() {
+		var paths []string
+		for _, f := range leafFiles(parseFileList(output)) {
+			paths = append(paths, f.Path)
+		}
+
+		Expect(paths).To(Equal([]string{
+			"data/empty",
+			"data/myapp/config.yml",
+			"data/myapp/file with spaces.txt",
+		}))
+	})
+})
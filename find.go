@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+type foundFile struct {
+	fileVersion
+	Path string
+}
+
+// runFind searches the local index for files matching the given glob
+// or regular expression (enclosed in slashes) without accessing the
+// backup itself
+func runFind(config *configFile, argv []string) error {
+	if len(argv) != 2 { //nolint:gomnd // Command and pattern
+		err := errors.New("You need to specify the pattern to search for: See help message")
+		logrus.WithError(err).Error("parsing find arguments")
+		return err
+	}
+
+	matcher, err := fileMatcher(argv[1])
+	if err != nil {
+		logrus.WithError(err).Error("parsing pattern")
+		return err
+	}
+
+	found, err := config.findIndexedFiles(matcher)
+	if err != nil {
+		logrus.WithError(err).Error("searching index")
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0) //nolint:gomnd // Padding of table cells
+	fmt.Fprintln(w, "MODIFIED\tFIRST BACKUP\tLAST BACKUP\tPATH")
+	for _, f := range found {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n",
+			f.ModTime.Format(historyTimeFormat),
+			f.FirstBackup.Format(historyTimeFormat),
+			f.LastBackup.Format(historyTimeFormat),
+			f.Path,
+		)
+	}
+
+	return errors.Wrap(w.Flush(), "writing results")
+}
+
+// fileMatcher creates a matcher from a regular expression enclosed in
+// slashes or a glob pattern. Globs without a slash are matched against
+// the file name, others against the whole path.
+func fileMatcher(pattern string) (func(string) bool, error) {
+	if len(pattern) > 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") { //nolint:gomnd // Two slashes
+		rex, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return nil, errors.Wrap(err, "compiling regular expression")
+		}
+		return rex.MatchString, nil
+	}
+
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, errors.Wrap(err, "parsing glob")
+	}
+
+	if !strings.Contains(pattern, "/") {
+		return func(p string) bool {
+			m, _ := path.Match(pattern, path.Base(p)) // #nosec G104 // Pattern was validated above
+			return m
+		}, nil
+	}
+
+	pattern = strings.TrimPrefix(pattern, "/")
+	return func(p string) bool {
+		m, _ := path.Match(pattern, p) // #nosec G104 // Pattern was validated above
+		return m
+	}, nil
+}
+
+// findIndexedFiles collects the versions of all files in the index
+// matching the matcher
+func (c *configFile) findIndexedFiles(matcher func(string) bool) ([]foundFile, error) {
+	db, err := c.openIndex()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close() //nolint:errcheck // Read-only usage
+
+	sets, err := indexedSets(db)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sets) == 0 {
+		logrus.Warn("Index is empty, run 'update-index' to populate it")
+	}
+
+	var (
+		found    []foundFile
+		versions = map[string]int{}
+	)
+
+	for _, set := range sets {
+		files, _, err := indexedFileList(db, set)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, f := range files {
+			if !matcher(f.Path) {
+				continue
+			}
+
+			key := fmt.Sprintf("%s\x00%d", f.Path, f.ModTime.Unix())
+			if idx, ok := versions[key]; ok {
+				found[idx].LastBackup = set.Time
+				found[idx].BackupSets++
+				continue
+			}
+
+			versions[key] = len(found)
+			found = append(found, foundFile{
+				fileVersion: fileVersion{ModTime: f.ModTime, FirstBackup: set.Time, LastBackup: set.Time, BackupSets: 1},
+				Path:        f.Path,
+			})
+		}
+	}
+
+	sort.SliceStable(found, func(i, j int) bool { return found[i].Path < found[j].Path })
+	return found, nil
+}
@@ -13,6 +13,7 @@ require (
 	github.com/pkg/errors v0.9.1
 	github.com/rifflock/lfshook v0.0.0-20180920164130-b9218ef580f5
 	github.com/sirupsen/logrus v1.9.3
+	go.etcd.io/bbolt v1.3.8
 	gopkg.in/yaml.v2 v2.4.0
 )
 
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/Luzifer/go_helpers/v2/str"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const percent = 100
+
+// changeGuardEnabled checks whether any of the guard thresholds is set
+func (c *configFile) changeGuardEnabled() bool {
+	return c.ChangeGuard.MaxDeletedRatio > 0 ||
+		c.ChangeGuard.MaxModifiedRatio > 0 ||
+		len(c.ChangeGuard.SuspiciousExtensions) > 0
+}
+
+// checkChangeGuard runs the change detection before a backup and fails
+// if the changes exceed the configured thresholds to prevent flooding
+// the backup with files encrypted by ransomware
+func (c *configFile) checkChangeGuard() error {
+	if !c.changeGuardEnabled() {
+		return nil
+	}
+
+	logrus.Info("++++ Checking changes before backup")
+
+	report, err := c.detectChanges()
+	if err != nil {
+		return errors.Wrap(err, "detecting changes")
+	}
+
+	if violations := c.changeGuardViolations(report); len(violations) > 0 {
+		return errors.Errorf("suspicious changes detected, backup aborted: %s", strings.Join(violations, ", "))
+	}
+
+	logrus.Infof("Change guard passed: %s", report.Total)
+	return nil
+}
+
+func (c *configFile) changeGuardViolations(report *changeReport) []string {
+	var violations []string
+
+	prev := report.previousFiles()
+	if prev < 0 && (c.ChangeGuard.MaxDeletedRatio > 0 || c.ChangeGuard.MaxModifiedRatio > 0) {
+		logrus.Warn("duplicity did not report statistics, unable to check fraction of changed files")
+	}
+
+	for _, check := range []struct {
+		name  string
+		count int
+		max   float64
+	}{
+		{"deleted", report.Total.Deleted, c.ChangeGuard.MaxDeletedRatio},
+		{"modified", report.Total.Modified, c.ChangeGuard.MaxModifiedRatio},
+	} {
+		if check.max <= 0 || prev <= 0 {
+			continue
+		}
+
+		if ratio := float64(check.count) / float64(prev); ratio > check.max {
+			violations = append(violations, fmt.Sprintf(
+				"%d of %d files %s (%.1f%%, threshold %.1f%%)",
+				check.count, prev, check.name, ratio*percent, check.max*percent,
+			))
+		}
+	}
+
+	if len(c.ChangeGuard.SuspiciousExtensions) > 0 {
+		var extensions []string
+		for _, ext := range c.ChangeGuard.SuspiciousExtensions {
+			extensions = append(extensions, "."+strings.TrimPrefix(strings.ToLower(ext), "."))
+		}
+
+		var suspicious int
+		for _, change := range report.Changes {
+			if change.Action != "D" && str.StringInSlice(strings.ToLower(path.Ext(change.Path)), extensions) {
+				logrus.Warnf("Suspicious file %s %q", change.Action, change.Path)
+				suspicious++
+			}
+		}
+
+		if suspicious > c.ChangeGuard.MaxSuspiciousFiles {
+			violations = append(violations, fmt.Sprintf(
+				"%d files with suspicious extensions (threshold %d)",
+				suspicious, c.ChangeGuard.MaxSuspiciousFiles,
+			))
+		}
+	}
+
+	return violations
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const historyTimeFormat = "2006-01-02 15:04:05"
+
+type fileVersion struct {
+	ModTime     time.Time
+	FirstBackup time.Time
+	LastBackup  time.Time
+	BackupSets  int
+}
+
+// runHistory lists all versions of the given path contained in the
+// backup sets with the backups they are contained in
+func runHistory(config *configFile, argv []string) error {
+	if len(argv) != 2 { //nolint:gomnd // Command and path
+		err := errors.New("You need to specify the path to show the history for: See help message")
+		logrus.WithError(err).Error("parsing history arguments")
+		return err
+	}
+
+	versions, err := config.fileHistory(config.relativeBackupPath(argv[1]))
+	if err != nil {
+		logrus.WithError(err).Error("collecting file history")
+		return err
+	}
+
+	if len(versions) == 0 {
+		logrus.Warnf("Path %q is not contained in any backup", argv[1])
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0) //nolint:gomnd // Padding of table cells
+	fmt.Fprintln(w, "MODIFIED\tFIRST BACKUP\tLAST BACKUP\tBACKUPS")
+	for _, v := range versions {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\n",
+			v.ModTime.Format(historyTimeFormat),
+			v.FirstBackup.Format(historyTimeFormat),
+			v.LastBackup.Format(historyTimeFormat),
+			v.BackupSets,
+		)
+	}
+
+	return errors.Wrap(w.Flush(), "writing history")
+}
+
+// fileHistory walks all backup sets and collects the distinct versions
+// of the path identified by their modification time
+func (c *configFile) fileHistory(p string) ([]fileVersion, error) {
+	sets, err := c.listBackupSets()
+	if err != nil {
+		return nil, errors.Wrap(err, "listing backup sets")
+	}
+
+	var (
+		versions []fileVersion
+		current  *fileVersion
+	)
+
+	for _, set := range sets {
+		files, err := c.cachedFileList(set)
+		if err != nil {
+			return nil, errors.Wrapf(err, "listing files of backup %s", set.Time)
+		}
+
+		f, found := findBackupFile(files, p)
+		switch {
+		case !found:
+			// Path was deleted, a later appearance is a new version
+			current = nil
+
+		case current != nil && current.ModTime.Equal(f.ModTime):
+			current.LastBackup = set.Time
+			current.BackupSets++
+
+		default:
+			versions = append(versions, fileVersion{
+				ModTime:     f.ModTime,
+				FirstBackup: set.Time,
+				LastBackup:  set.Time,
+				BackupSets:  1,
+			})
+			current = &versions[len(versions)-1]
+		}
+	}
+
+	return versions, nil
+}
+
+func findBackupFile(files []backupFile, p string) (backupFile, bool) {
+	for _, f := range files {
+		if f.Path == p {
+			return f, true
+		}
+	}
+
+	return backupFile{}, false
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Luzifer/go_helpers/v2/env"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	hookStagePre       = "pre"
+	hookStagePost      = "post"
+	hookStageOnSuccess = "on_success"
+	hookStageOnFailure = "on_failure"
+
+	hookFailureAbort    = "abort"
+	hookFailureContinue = "continue"
+
+	defaultHookTimeout = time.Hour
+)
+
+type (
+	hookConfig struct {
+		Command       []string          `yaml:"command"`
+		Timeout       time.Duration     `yaml:"timeout"`
+		Env           map[string]string `yaml:"env"`
+		FailurePolicy string            `yaml:"failure_policy"`
+	}
+
+	commandHooks struct {
+		Pre       []hookConfig `yaml:"pre"`
+		Post      []hookConfig `yaml:"post"`
+		OnSuccess []hookConfig `yaml:"on_success"`
+		OnFailure []hookConfig `yaml:"on_failure"`
+	}
+
+	// hookRunInfo contains the information about the current run
+	// passed to the hooks through their environment
+	hookRunInfo struct {
+		Command string
+		LogFile string
+		Err     error
+	}
+)
+
+func (c commandHooks) stage(stage string) []hookConfig {
+	switch stage {
+	case hookStagePre:
+		return c.Pre
+	case hookStagePost:
+		return c.Post
+	case hookStageOnSuccess:
+		return c.OnSuccess
+	case hookStageOnFailure:
+		return c.OnFailure
+	default:
+		return nil
+	}
+}
+
+func (h hookConfig) validate() error {
+	if len(h.Command) == 0 {
+		return errors.New("hook has no command")
+	}
+
+	if h.FailurePolicy != "" && h.FailurePolicy != hookFailureAbort && h.FailurePolicy != hookFailureContinue {
+		return errors.Errorf("hook %q has unknown failure_policy %q", h.Command[0], h.FailurePolicy)
+	}
+
+	return nil
+}
+
+func (r hookRunInfo) env(stage string) map[string]string {
+	vars := map[string]string{
+		"DUPLICITY_BACKUP_COMMAND":     r.Command,
+		"DUPLICITY_BACKUP_DRY_RUN":     strconv.FormatBool(cfg.DryRun),
+		"DUPLICITY_BACKUP_EXIT_STATUS": strconv.Itoa(exitCode(r.Err)),
+		"DUPLICITY_BACKUP_LOG_FILE":    r.LogFile,
+		"DUPLICITY_BACKUP_STAGE":       stage,
+	}
+
+	if r.Err != nil {
+		vars["DUPLICITY_BACKUP_ERROR"] = r.Err.Error()
+	}
+
+	return vars
+}
+
+// runHooks executes the hooks configured for the command in the given
+// stage. Failing hooks with the abort policy stop the execution of the
+// remaining hooks of this stage and return an error.
+func (c *configFile) runHooks(stage string, run hookRunInfo) error {
+	hooks := c.Hooks[run.Command].stage(stage)
+	if len(hooks) == 0 {
+		return nil
+	}
+
+	logrus.Infof("++++ Executing %s hooks", stage)
+
+	// Hooks following the command need to run for cleanups even when
+	// the wrapper was interrupted
+	ctx := context.Background()
+	if stage == hookStagePre {
+		ctx = interruptCtx
+	}
+
+	for _, h := range hooks {
+		err := h.run(ctx, run.env(stage))
+		if err == nil {
+			continue
+		}
+
+		if h.FailurePolicy == hookFailureContinue {
+			logrus.WithError(err).Warnf("%s hook %q failed, continuing", stage, h.Command[0])
+			continue
+		}
+
+		logrus.WithError(err).Errorf("%s hook %q failed", stage, h.Command[0])
+		return exitCodeError{code: exitCodeHook, err: errors.Wrapf(err, "executing %s hook %q", stage, h.Command[0])}
+	}
+
+	return nil
+}
+
+func (h hookConfig) run(ctx context.Context, runEnv map[string]string) error {
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = defaultHookTimeout
+	}
+
+	return runLoggedCommand(ctx, h.Command, []map[string]string{h.Env, runEnv}, timeout, logrus.WithField("hook", h.Command[0]))
+}
+
+// runLoggedCommand executes the command with the given additional
+// environment variables and writes its output to the log. The command
+// is stopped when the context is cancelled or the timeout is reached.
+func runLoggedCommand(ctx context.Context, command []string, extraEnv []map[string]string, timeout time.Duration, logger *logrus.Entry) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	procEnv := env.ListToMap(os.Environ())
+	for _, vars := range extraEnv {
+		for k, v := range vars {
+			procEnv[k] = v
+		}
+	}
+
+	logger.Debugf("Command: %s", strings.Join(command, " "))
+
+	var (
+		msgChan  = make(chan string, messageChanSize)
+		procDone = make(chan struct{})
+	)
+
+	go func() {
+		defer close(procDone)
+		for l := range msgChan {
+			logger.Info(l)
+		}
+	}()
+
+	output := newMessageChanWriter(msgChan)
+	cmd := interruptibleCommand(ctx, command[0], command[1:]...)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	cmd.Env = env.MapToList(procEnv)
+	err := cmd.Run()
+
+	close(msgChan)
+	<-procDone
+
+	if err := interruptError(); err != nil && ctx.Err() != nil {
+		return errors.Wrap(err, "interrupted")
+	}
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return errors.Errorf("timed out after %s", timeout)
+	}
+
+	return errors.Wrap(err, "running command")
+}
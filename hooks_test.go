@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+)
+
+var _ = Describe("Hooks", func() {
+	It("should describe the run in the environment", func() {
+		Expect(hookRunInfo{Command: commandBackup, LogFile: "/var/log/run.txt"}.env(hookStagePost)).To(Equal(map[string]string{
+			"DUPLICITY_BACKUP_COMMAND":     commandBackup,
+			"DUPLICITY_BACKUP_DRY_RUN":     "false",
+			"DUPLICITY_BACKUP_EXIT_STATUS": "0",
+			"DUPLICITY_BACKUP_LOG_FILE":    "/var/log/run.txt",
+			"DUPLICITY_BACKUP_STAGE":       hookStagePost,
+		}))
+
+		vars := hookRunInfo{
+			Command: commandBackup,
+			Err:     exitCodeError{code: exitCodeDump, err: errors.New("dump failed")},
+		}.env(hookStageOnFailure)
+		Expect(vars).To(HaveKeyWithValue("DUPLICITY_BACKUP_EXIT_STATUS", "85"))
+		Expect(vars).To(HaveKeyWithValue("DUPLICITY_BACKUP_ERROR", "dump failed"))
+		Expect(vars).To(HaveKeyWithValue("DUPLICITY_BACKUP_STAGE", hookStageOnFailure))
+	})
+
+	Context("with failing hooks", func() {
+		var (
+			tmp    string
+			marker string
+			config configFile
+		)
+
+		// hooks returns a failing hook with the given policy followed by
+		// a hook creating the marker file
+		hooks := func(policy string) []hookConfig {
+			return []hookConfig{
+				{Command: []string{"sh", "-c", "exit 1"}, FailurePolicy: policy},
+				{Command: []string{"sh", "-c", `echo "$DUPLICITY_BACKUP_STAGE" >"$MARKER"`}, Env: map[string]string{"MARKER": marker}},
+			}
+		}
+
+		BeforeEach(func() {
+			var err error
+			tmp, err = os.MkdirTemp("", "duplicity-backup-test-")
+			Expect(err).NotTo(HaveOccurred())
+
+			marker = filepath.Join(tmp, "marker")
+			config = configFile{}
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(tmp)).To(Succeed())
+		})
+
+		It("should abort the stage by default", func() {
+			config.Hooks = map[string]commandHooks{commandBackup: {Pre: hooks("")}}
+
+			err := config.runHooks(hookStagePre, hookRunInfo{Command: commandBackup})
+			Expect(err).To(HaveOccurred())
+			Expect(exitCode(err)).To(Equal(exitCodeHook))
+			Expect(marker).NotTo(BeAnExistingFile())
+		})
+
+		It("should continue with the remaining hooks", func() {
+			config.Hooks = map[string]commandHooks{commandBackup: {Post: hooks(hookFailureContinue)}}
+
+			Expect(config.runHooks(hookStagePost, hookRunInfo{Command: commandBackup})).To(Succeed())
+
+			content, err := os.ReadFile(marker)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(content)).To(Equal(hookStagePost + "\n"))
+		})
+
+		It("should only run hooks of the command", func() {
+			config.Hooks = map[string]commandHooks{commandCleanup: {Pre: hooks("")}}
+
+			Expect(config.runHooks(hookStagePre, hookRunInfo{Command: commandBackup})).To(Succeed())
+		})
+	})
+})
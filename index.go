@@ -0,0 +1,252 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	cacheDirPerms       = 0o700
+	defaultCacheDirPath = "~/.cache/duplicity-backup"
+	indexFilePerms      = 0o600
+	indexOpenTimeout    = 10 * time.Second
+)
+
+var (
+	indexBucketSets  = []byte("sets")
+	indexBucketFiles = []byte("files")
+	indexKeyInfo     = []byte("info")
+)
+
+// cacheDir returns the directory to store cached data for the
+// configured destination in
+func (c *configFile) cacheDir() (string, error) {
+	dir := c.CacheDirectory
+	if dir == "" {
+		dir = defaultCacheDirPath
+	}
+
+	dir, err := homedir.Expand(dir)
+	if err != nil {
+		return "", errors.Wrap(err, "expanding cache directory")
+	}
+
+	return filepath.Join(dir, fmt.Sprintf("%x", sha256.Sum256([]byte(c.Destination)))[:16]), nil
+}
+
+// openIndex opens the local index of the backup contents. The index
+// contains a bucket per backup set holding its info and file listing.
+func (c *configFile) openIndex() (*bolt.DB, error) {
+	dir, err := c.cacheDir()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = os.MkdirAll(dir, cacheDirPerms); err != nil {
+		return nil, errors.Wrap(err, "creating cache directory")
+	}
+
+	db, err := bolt.Open(filepath.Join(dir, "index.db"), indexFilePerms, &bolt.Options{Timeout: indexOpenTimeout})
+	if err != nil {
+		return nil, errors.Wrap(err, "opening index")
+	}
+
+	if err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(indexBucketSets)
+		return errors.Wrap(err, "creating sets bucket")
+	}); err != nil {
+		db.Close() //nolint:errcheck,gosec // Already failing, error is reported
+		return nil, err
+	}
+
+	return db, nil
+}
+
+func indexSetKey(set backupSet) []byte {
+	key := make([]byte, 8) //nolint:gomnd // Size of uint64
+	binary.BigEndian.PutUint64(key, uint64(set.Time.Unix()))
+	return key
+}
+
+// cachedFileList returns the files contained in the given backup set.
+// As backup sets never change their listings are served from the index
+// and only fetched from the backup if not yet indexed.
+func (c *configFile) cachedFileList(set backupSet) ([]backupFile, error) {
+	db, err := c.openIndex()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close() //nolint:errcheck // Read-only usage or already committed
+
+	files, found, err := indexedFileList(db, set)
+	if err != nil || found {
+		return files, err
+	}
+
+	if files, err = c.listFiles(set.duplicityTime()); err != nil {
+		return nil, err
+	}
+
+	return files, storeIndexedSet(db, set, files)
+}
+
+func indexedFileList(db *bolt.DB, set backupSet) (files []backupFile, found bool, err error) {
+	err = db.View(func(tx *bolt.Tx) error {
+		setBucket := tx.Bucket(indexBucketSets).Bucket(indexSetKey(set))
+		if setBucket == nil {
+			return nil
+		}
+
+		found = true
+		return setBucket.Bucket(indexBucketFiles).ForEach(func(k, v []byte) error {
+			files = append(files, backupFile{
+				Path:    string(k),
+				ModTime: time.Unix(int64(binary.BigEndian.Uint64(v)), 0),
+			})
+			return nil
+		})
+	})
+
+	return files, found, errors.Wrap(err, "reading index")
+}
+
+func storeIndexedSet(db *bolt.DB, set backupSet, files []backupFile) error {
+	return errors.Wrap(db.Update(func(tx *bolt.Tx) error {
+		sets := tx.Bucket(indexBucketSets)
+		if err := sets.DeleteBucket(indexSetKey(set)); err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+			return errors.Wrap(err, "removing outdated set")
+		}
+
+		setBucket, err := sets.CreateBucket(indexSetKey(set))
+		if err != nil {
+			return errors.Wrap(err, "creating set bucket")
+		}
+
+		info, err := json.Marshal(set)
+		if err != nil {
+			return errors.Wrap(err, "encoding set info")
+		}
+
+		if err = setBucket.Put(indexKeyInfo, info); err != nil {
+			return errors.Wrap(err, "storing set info")
+		}
+
+		filesBucket, err := setBucket.CreateBucket(indexBucketFiles)
+		if err != nil {
+			return errors.Wrap(err, "creating files bucket")
+		}
+
+		for _, f := range files {
+			mtime := make([]byte, 8) //nolint:gomnd // Size of uint64
+			binary.BigEndian.PutUint64(mtime, uint64(f.ModTime.Unix()))
+			if err = filesBucket.Put([]byte(f.Path), mtime); err != nil {
+				return errors.Wrap(err, "storing file")
+			}
+		}
+
+		return nil
+	}), "updating index")
+}
+
+// runUpdateIndex brings the local index up to date with the backup
+func runUpdateIndex(config *configFile) error {
+	err := config.updateIndex()
+	if err != nil {
+		logrus.WithError(err).Error("updating index")
+	}
+
+	return err
+}
+
+// indexedSets returns the info of all backup sets stored in the index
+// ordered by their time
+func indexedSets(db *bolt.DB) ([]backupSet, error) {
+	var sets []backupSet
+
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(indexBucketSets).ForEachBucket(func(k []byte) error {
+			var set backupSet
+			if err := json.Unmarshal(tx.Bucket(indexBucketSets).Bucket(k).Get(indexKeyInfo), &set); err != nil {
+				return errors.Wrap(err, "decoding set info")
+			}
+			sets = append(sets, set)
+			return nil
+		})
+	})
+
+	return sets, errors.Wrap(err, "reading index")
+}
+
+// updateIndexAfterBackup reports whether the index is refreshed after
+// each successful backup which is done unless disabled in the config
+func (c *configFile) updateIndexAfterBackup() bool {
+	return c.Index.UpdateAfterBackup == nil || *c.Index.UpdateAfterBackup
+}
+
+// updateIndex adds all backup sets not yet indexed to the index and
+// removes sets no longer present in the backup
+func (c *configFile) updateIndex() error {
+	sets, err := c.listBackupSets()
+	if err != nil {
+		return errors.Wrap(err, "listing backup sets")
+	}
+
+	db, err := c.openIndex()
+	if err != nil {
+		return err
+	}
+	defer db.Close() //nolint:errcheck // Changes are already committed
+
+	indexed, err := indexedSets(db)
+	if err != nil {
+		return err
+	}
+
+	available := map[int64]bool{}
+	for _, set := range sets {
+		available[set.Time.Unix()] = true
+	}
+
+	isIndexed := map[int64]bool{}
+	for _, set := range indexed {
+		if available[set.Time.Unix()] {
+			isIndexed[set.Time.Unix()] = true
+			continue
+		}
+
+		logrus.Infof("Removing backup set %s from index", set.Time)
+		if err = db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(indexBucketSets).DeleteBucket(indexSetKey(set))
+		}); err != nil {
+			return errors.Wrap(err, "removing set from index")
+		}
+	}
+
+	for _, set := range sets {
+		if isIndexed[set.Time.Unix()] {
+			continue
+		}
+
+		logrus.Infof("Adding backup set %s to index", set.Time)
+		files, err := c.listFiles(set.duplicityTime())
+		if err != nil {
+			return errors.Wrapf(err, "listing files of backup %s", set.Time)
+		}
+
+		if err = storeIndexedSet(db, set, files); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
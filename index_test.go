@@ -0,0 +1,109 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Index", func() {
+	var (
+		config *configFile
+		tmp    string
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = os.MkdirTemp("", "duplicity-backup-test-")
+		Expect(err).NotTo(HaveOccurred())
+
+		config = &configFile{CacheDirectory: tmp, Destination: "file:///backup"}
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(tmp)).To(Succeed())
+	})
+
+	It("should store and read back backup sets", func() {
+		db, err := config.openIndex()
+		Expect(err).NotTo(HaveOccurred())
+		defer db.Close() //nolint:errcheck // Test cleanup
+
+		var (
+			full = backupSet{Type: "Full", Time: time.Date(2023, 10, 8, 2, 0, 1, 0, time.UTC), Volumes: 3}
+			inc  = backupSet{Type: "Incremental", Time: time.Date(2023, 10, 9, 2, 0, 1, 0, time.UTC), Volumes: 1}
+		)
+
+		_, found, err := indexedFileList(db, full)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(found).To(BeFalse())
+
+		Expect(storeIndexedSet(db, full, []backupFile{
+			{Path: "data/old.txt", ModTime: time.Unix(1696723200, 0)},
+		})).To(Succeed())
+		Expect(storeIndexedSet(db, full, []backupFile{
+			{Path: "data/myapp/config.yml", ModTime: time.Unix(1696809600, 0)},
+			{Path: "data", ModTime: time.Unix(1696809601, 0)},
+		})).To(Succeed())
+		Expect(storeIndexedSet(db, inc, nil)).To(Succeed())
+
+		files, found, err := indexedFileList(db, full)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(found).To(BeTrue())
+		Expect(files).To(Equal([]backupFile{
+			{Path: "data", ModTime: time.Unix(1696809601, 0)},
+			{Path: "data/myapp/config.yml", ModTime: time.Unix(1696809600, 0)},
+		}))
+
+		files, found, err = indexedFileList(db, inc)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(found).To(BeTrue())
+		Expect(files).To(BeEmpty())
+
+		sets, err := indexedSets(db)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sets).To(HaveLen(2))
+		Expect(sets[0].Type).To(Equal(full.Type))
+		Expect(sets[0].Time.Equal(full.Time)).To(BeTrue())
+		Expect(sets[0].Volumes).To(Equal(full.Volumes))
+		Expect(sets[1].Time.Equal(inc.Time)).To(BeTrue())
+	})
+
+	It("should match file names, paths and regular expressions", func() {
+		for pattern, expect := range map[string]map[string]bool{
+			"*.yml": {
+				"data/myapp/config.yml": true,
+				"config.yml":            true,
+				"data/myapp.yml/file":   false,
+			},
+			"data/*/config.yml": {
+				"data/myapp/config.yml":       true,
+				"data/myapp/other/config.yml": false,
+			},
+			"/data/*": {
+				"data/file.txt": true,
+				"data":          false,
+			},
+			"/my(app|db)/": {
+				"data/myapp/config.yml": true,
+				"data/mydb":             true,
+				"data/other":            false,
+			},
+		} {
+			match, err := fileMatcher(pattern)
+			Expect(err).NotTo(HaveOccurred())
+
+			for p, matches := range expect {
+				Expect(match(p)).To(Equal(matches), "pattern %q on %q", pattern, p)
+			}
+		}
+
+		_, err := fileMatcher("/(/")
+		Expect(err).To(HaveOccurred())
+
+		_, err = fileMatcher("[")
+		Expect(err).To(HaveOccurred())
+	})
+})
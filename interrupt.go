@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// interruptCtx is cancelled when the wrapper receives SIGINT or
+	// SIGTERM to stop the running commands
+	interruptCtx, interruptCancel = context.WithCancel(context.Background())
+	interruptSignal               atomic.Value
+)
+
+// handleInterrupts catches SIGINT / SIGTERM instead of letting them
+// kill the wrapper so running commands can be stopped gracefully and
+// the lock, snapshots and dumps are cleaned up afterwards
+func handleInterrupts() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		for sig := range signals {
+			if interruptCtx.Err() != nil {
+				logrus.Warnf("Received %s, already shutting down", sig)
+				continue
+			}
+
+			logrus.Warnf("Received %s, stopping running commands (grace period %s)", sig, cfg.GracePeriod)
+			interruptSignal.Store(sig)
+			interruptCancel()
+		}
+	}()
+}
+
+// interruptError returns an error describing the interruption if the
+// wrapper was interrupted
+func interruptError() error {
+	sig, ok := interruptSignal.Load().(os.Signal)
+	if !ok {
+		return nil
+	}
+
+	return errors.Errorf("received signal %s", sig)
+}
+
+// interruptibleCommand creates a command which receives the signal the
+// wrapper was interrupted with (or SIGTERM on timeouts) as soon as the
+// context is done and gets killed after the grace period
+func interruptibleCommand(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...) // #nosec G204 // Intended to run configured commands
+	cmd.Cancel = func() error {
+		sig, ok := interruptSignal.Load().(os.Signal)
+		if !ok {
+			sig = syscall.SIGTERM
+		}
+
+		return cmd.Process.Signal(sig)
+	}
+	cmd.WaitDelay = cfg.GracePeriod
+
+	return cmd
+}
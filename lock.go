@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/nightlyone/lockfile"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const lockRetryInterval = 5 * time.Second
+
+type (
+	// lockInfo describes the holder of the lock and is stored in the
+	// lockfile after the PID line used by the lockfile package
+	lockInfo struct {
+		PID      int       `json:"pid"`
+		Hostname string    `json:"hostname"`
+		Command  string    `json:"command"`
+		Started  time.Time `json:"started"`
+	}
+
+	// skippedError is returned when the command was not executed as
+	// its preconditions were not met
+	skippedError struct {
+		reason string
+	}
+)
+
+func (s skippedError) Error() string { return s.reason }
+
+func (l lockInfo) String() string {
+	if l.Command == "" {
+		// Lock created by an older version without metadata
+		return fmt.Sprintf("PID %d", l.PID)
+	}
+
+	return fmt.Sprintf("PID %d on %s running %q since %s",
+		l.PID, l.Hostname, l.Command, l.Started.Format(time.RFC3339))
+}
+
+// acquireLock takes the lock for the given command. Locks of processes
+// no longer running are taken over. If the lock is held by a running
+// process it is retried until the wait time is exceeded.
+func acquireLock(lock lockfile.Lockfile, command string, wait time.Duration) error {
+	deadline := time.Now().Add(wait)
+
+	if _, err := lock.GetOwner(); errors.Is(err, lockfile.ErrDeadOwner) {
+		if info, err := readLockInfo(string(lock)); err == nil {
+			logrus.Warnf("Taking over stale lock of %s", info)
+		}
+	}
+
+	for {
+		err := lock.TryLock()
+		switch {
+		case err == nil:
+			return errors.Wrap(writeLockInfo(string(lock), command), "writing lock metadata")
+
+		case errors.Is(err, lockfile.ErrNotExist):
+			// Lock was released while trying to take it
+			continue
+
+		case !errors.Is(err, lockfile.ErrBusy):
+			return errors.Wrap(err, "acquiring lock")
+		}
+
+		info, iErr := readLockInfo(string(lock))
+		if iErr != nil {
+			// Lock is busy, its holder is only unknown
+			logrus.WithError(iErr).Debug("reading lock holder")
+		}
+
+		if time.Now().Add(lockRetryInterval).After(deadline) {
+			return skippedError{reason: fmt.Sprintf("lock is held by %s", info)}
+		}
+
+		logrus.Infof("Waiting for lock held by %s", info)
+		select {
+		case <-interruptCtx.Done():
+			return errors.Wrap(interruptError(), "waiting for lock")
+		case <-time.After(lockRetryInterval):
+		}
+	}
+}
+
+// writeLockInfo appends the metadata of this run to the lockfile
+// already containing the PID
+func writeLockInfo(lockPath, command string) error {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return errors.Wrap(err, "getting hostname")
+	}
+
+	f, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_APPEND, 0) //#nosec:G304 // Lockfile path is intended to be configurable
+	if err != nil {
+		return errors.Wrap(err, "opening lockfile")
+	}
+	defer f.Close() //nolint:errcheck // Close is checked below
+
+	if err = json.NewEncoder(f).Encode(lockInfo{
+		PID:      os.Getpid(),
+		Hostname: hostname,
+		Command:  command,
+		Started:  time.Now(),
+	}); err != nil {
+		return errors.Wrap(err, "encoding metadata")
+	}
+
+	return errors.Wrap(f.Close(), "closing lockfile")
+}
+
+// readLockInfo reads the PID and the metadata (if present) from the
+// lockfile. Metadata not yet completely written by the holder is
+// ignored.
+func readLockInfo(lockPath string) (info lockInfo, err error) {
+	f, err := os.Open(lockPath) //#nosec:G304 // Lockfile path is intended to be configurable
+	if err != nil {
+		return info, errors.Wrap(err, "opening lockfile")
+	}
+	defer f.Close() //nolint:errcheck // File is only read
+
+	r := bufio.NewReader(f)
+	if _, err = fmt.Fscanln(r, &info.PID); err != nil {
+		return info, errors.Wrap(err, "reading PID")
+	}
+
+	var meta lockInfo
+	if err = json.NewDecoder(r).Decode(&meta); err != nil {
+		if !errors.Is(err, io.EOF) {
+			logrus.WithError(err).Debug("decoding lock metadata, using PID only")
+		}
+		return info, nil
+	}
+
+	// PID line is the one checked by the lockfile package
+	meta.PID = info.PID
+	return meta, nil
+}
+
+// runLockStatus prints whether the lock is held and by whom
+func runLockStatus(lock lockfile.Lockfile) error {
+	info, err := readLockInfo(string(lock))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		fmt.Println("Lock is free")
+		return nil
+
+	case err != nil:
+		return err
+	}
+
+	_, err = lock.GetOwner()
+	switch {
+	case err == nil:
+		fmt.Printf("Lock is held by %s\n", info)
+
+	case errors.Is(err, lockfile.ErrDeadOwner):
+		fmt.Printf("Lock is stale (process not running), held by %s\n", info)
+
+	default:
+		return errors.Wrap(err, "checking lock owner")
+	}
+
+	return nil
+}
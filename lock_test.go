@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/nightlyone/lockfile"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Lock", func() {
+	var (
+		tmp  string
+		lock lockfile.Lockfile
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = os.MkdirTemp("", "duplicity-backup-test-")
+		Expect(err).NotTo(HaveOccurred())
+
+		lock, err = lockfile.New(filepath.Join(tmp, "lock"))
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(tmp)).To(Succeed())
+	})
+
+	writeLock := func(content string) {
+		Expect(os.WriteFile(string(lock), []byte(content), 0o600)).To(Succeed())
+	}
+
+	It("should store the metadata readable by the lockfile package", func() {
+		Expect(acquireLock(lock, commandBackup, 0)).To(Succeed())
+
+		info, err := readLockInfo(string(lock))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.PID).To(Equal(os.Getpid()))
+		Expect(info.Command).To(Equal(commandBackup))
+		Expect(info.Started).NotTo(BeZero())
+
+		owner, err := lock.GetOwner()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(owner.Pid).To(Equal(os.Getpid()))
+
+		Expect(lock.Unlock()).To(Succeed())
+	})
+
+	It("should read lockfiles without or with partial metadata", func() {
+		writeLock("1234\n")
+		info, err := readLockInfo(string(lock))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info).To(Equal(lockInfo{PID: 1234}))
+
+		writeLock("1234\n{\"pid\":1234,\"hostn")
+		info, err = readLockInfo(string(lock))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info).To(Equal(lockInfo{PID: 1234}))
+	})
+
+	It("should skip the run while the lock is held by a running process", func() {
+		writeLock(fmt.Sprintf("%d\n{\"pid\":%[1]d,\"hostname\":\"other\",\"command\":\"full\"}\n", os.Getppid()))
+
+		err := acquireLock(lock, commandBackup, 0)
+		Expect(err).To(BeAssignableToTypeOf(skippedError{}))
+		Expect(err.Error()).To(ContainSubstring(`running "full"`))
+		Expect(exitCode(err)).To(Equal(exitCodeLockBusy))
+
+		// Partial metadata does not turn the skip into a failure
+		writeLock(fmt.Sprintf("%d\n{\"pid\":", os.Getppid()))
+		Expect(acquireLock(lock, commandBackup, 0)).To(BeAssignableToTypeOf(skippedError{}))
+	})
+})
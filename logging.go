@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Luzifer/go_helpers/v2/str"
+	"github.com/pkg/errors"
+	"github.com/rifflock/lfshook"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	logOutputFile     = "file"
+	logOutputStdout   = "stdout"
+	logOutputJournald = "journald"
+	logOutputSyslog   = "syslog"
+
+	logFormatText = "text"
+	logFormatJSON = "json"
+
+	defaultJournaldSocket = "/run/systemd/journal/socket"
+	defaultSyslogAddress  = "unix:///dev/log"
+	defaultSyslogTag      = "duplicity-backup"
+
+	syslogFacilityUser = 1
+	syslogFacilityBits = 3
+)
+
+var (
+	logOutputTypes   = []string{logOutputFile, logOutputStdout, logOutputJournald, logOutputSyslog}
+	logFormats       = []string{"", logFormatText, logFormatJSON}
+	journaldFieldsRE = regexp.MustCompile(`[^A-Z0-9_]`)
+)
+
+type (
+	loggingConfig struct {
+		Job     string            `yaml:"job"`
+		Outputs []logOutputConfig `yaml:"outputs"`
+	}
+
+	logOutputConfig struct {
+		Type    string `yaml:"type"`
+		Format  string `yaml:"format"`
+		Address string `yaml:"address"`
+		Tag     string `yaml:"tag"`
+	}
+
+	// writerHook writes all entries to the writer using its formatter
+	writerHook struct {
+		w         io.Writer
+		formatter logrus.Formatter
+	}
+
+	// journaldHook sends entries using the native journald protocol
+	// including the fields of the entry as journal fields
+	journaldHook struct {
+		conn   net.Conn
+		fields map[string]string
+	}
+
+	// syslogHook sends entries formatted as syslog messages to a local
+	// socket or a remote syslog server
+	syslogHook struct {
+		conn      net.Conn
+		formatter logrus.Formatter
+		local     bool
+		stream    bool
+		hostname  string
+		tag       string
+	}
+)
+
+func (o logOutputConfig) validate() error {
+	if !str.StringInSlice(o.Type, logOutputTypes) {
+		return errors.Errorf("unknown output type %q, use one of: %s", o.Type, strings.Join(logOutputTypes, ", "))
+	}
+
+	if !str.StringInSlice(o.Format, logFormats) {
+		return errors.Errorf("unknown format %q, use text or json", o.Format)
+	}
+
+	return nil
+}
+
+// writesLogFile reports whether the log file of the run is written
+func (c *configFile) writesLogFile() bool {
+	if len(c.Logging.Outputs) == 0 {
+		return true
+	}
+
+	for _, o := range c.Logging.Outputs {
+		if o.Type == logOutputFile {
+			return true
+		}
+	}
+
+	return false
+}
+
+// setupLogging configures the log outputs. Without configured outputs
+// logs are written to the console and the log file of the run.
+func (c *configFile) setupLogging(logFile io.Writer, command string) error {
+	if len(c.Logging.Outputs) == 0 {
+		logrus.AddHook(lfshook.NewHook(logFile, nil))
+		if cfg.Silent {
+			logrus.SetOutput(io.Discard)
+		}
+		return nil
+	}
+
+	// All outputs are realized as hooks
+	logrus.SetOutput(io.Discard)
+
+	var errs []string
+	for _, o := range c.Logging.Outputs {
+		hook, err := c.logOutputHook(o, logFile, command)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", o.Type, err))
+			continue
+		}
+
+		if hook != nil {
+			logrus.AddHook(hook)
+		}
+	}
+
+	if len(errs) > 0 {
+		// Ensure the failure is visible even if no output is working
+		logrus.SetOutput(os.Stderr)
+		return errors.Errorf("setting up log outputs failed:\n- %s", strings.Join(errs, "\n- "))
+	}
+
+	return nil
+}
+
+func (c *configFile) logOutputHook(o logOutputConfig, logFile io.Writer, command string) (logrus.Hook, error) {
+	formatter := logrus.Formatter(&logrus.TextFormatter{DisableColors: true, FullTimestamp: true})
+	if o.Format == logFormatJSON {
+		formatter = &logrus.JSONFormatter{}
+	}
+
+	switch o.Type {
+	case logOutputFile:
+		return writerHook{w: logFile, formatter: formatter}, nil
+
+	case logOutputStdout:
+		if cfg.Silent {
+			return nil, nil
+		}
+
+		if o.Format != logFormatJSON {
+			formatter = &logrus.TextFormatter{}
+		}
+		return writerHook{w: os.Stdout, formatter: formatter}, nil
+
+	case logOutputJournald:
+		return c.newJournaldHook(o, command)
+
+	case logOutputSyslog:
+		return c.newSyslogHook(o, formatter)
+
+	default:
+		return nil, errors.Errorf("unknown output type %q", o.Type)
+	}
+}
+
+// logJob returns the name of the job used in structured logs, defaults
+// to the name of the config file
+func (c *configFile) logJob() string {
+	if c.Logging.Job != "" {
+		return c.Logging.Job
+	}
+
+	return strings.TrimSuffix(filepath.Base(cfg.ConfigFile), filepath.Ext(cfg.ConfigFile))
+}
+
+func (writerHook) Levels() []logrus.Level { return logrus.AllLevels }
+
+func (w writerHook) Fire(entry *logrus.Entry) error {
+	line, err := w.formatter.Format(entry)
+	if err != nil {
+		return errors.Wrap(err, "formatting entry")
+	}
+
+	_, err = w.w.Write(line)
+	return errors.Wrap(err, "writing entry")
+}
+
+func (c *configFile) newJournaldHook(o logOutputConfig, command string) (logrus.Hook, error) {
+	address := o.Address
+	if address == "" {
+		address = defaultJournaldSocket
+	}
+
+	conn, err := net.Dial("unixgram", address)
+	if err != nil {
+		return nil, errors.Wrap(err, "connecting to journald")
+	}
+
+	tag := o.Tag
+	if tag == "" {
+		tag = defaultSyslogTag
+	}
+
+	return journaldHook{conn: conn, fields: map[string]string{
+		"SYSLOG_IDENTIFIER": tag,
+		"JOB":               c.logJob(),
+		"COMMAND":           command,
+		"HOSTNAME":          c.Hostname,
+	}}, nil
+}
+
+func (journaldHook) Levels() []logrus.Level { return logrus.AllLevels }
+
+func (j journaldHook) Fire(entry *logrus.Entry) error {
+	fields := map[string]string{
+		"MESSAGE":  entry.Message,
+		"PRIORITY": fmt.Sprintf("%d", syslogSeverity(entry.Level)),
+	}
+
+	for k, v := range j.fields {
+		fields[k] = v
+	}
+
+	for k, v := range entry.Data {
+		// Journal fields must consist of uppercase letters, digits and
+		// underscores and must not start with an underscore
+		name := strings.TrimLeft(journaldFieldsRE.ReplaceAllString(strings.ToUpper(k), "_"), "_")
+		if name == "" {
+			continue
+		}
+
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		fields[name] = fmt.Sprint(v)
+	}
+
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	for _, k := range keys {
+		v := fields[k]
+		if !strings.Contains(v, "\n") {
+			fmt.Fprintf(&buf, "%s=%s\n", k, v)
+			continue
+		}
+
+		// Values containing newlines are sent with explicit length
+		buf.WriteString(k + "\n")
+		if err := binary.Write(&buf, binary.LittleEndian, uint64(len(v))); err != nil {
+			return errors.Wrap(err, "encoding field length")
+		}
+		buf.WriteString(v + "\n")
+	}
+
+	_, err := j.conn.Write(buf.Bytes())
+	return errors.Wrap(err, "sending entry to journald")
+}
+
+func (c *configFile) newSyslogHook(o logOutputConfig, formatter logrus.Formatter) (logrus.Hook, error) {
+	address := o.Address
+	if address == "" {
+		address = defaultSyslogAddress
+	}
+
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing address")
+	}
+
+	h := syslogHook{formatter: formatter, hostname: c.Hostname, tag: o.Tag}
+	if h.tag == "" {
+		h.tag = defaultSyslogTag
+	}
+
+	switch u.Scheme {
+	case "unix":
+		// Local syslog might listen on a datagram or stream socket
+		h.local = true
+		if h.conn, err = net.Dial("unixgram", u.Path); err != nil {
+			h.stream = true
+			h.conn, err = net.Dial("unix", u.Path)
+		}
+
+	case "udp":
+		h.conn, err = net.Dial("udp", u.Host)
+
+	case "tcp":
+		h.stream = true
+		h.conn, err = net.Dial("tcp", u.Host)
+
+	default:
+		return nil, errors.Errorf("unsupported syslog address %q, use unix://, udp:// or tcp://", address)
+	}
+
+	return h, errors.Wrap(err, "connecting to syslog")
+}
+
+func (syslogHook) Levels() []logrus.Level { return logrus.AllLevels }
+
+func (s syslogHook) Fire(entry *logrus.Entry) error {
+	msg, err := s.formatter.Format(entry)
+	if err != nil {
+		return errors.Wrap(err, "formatting entry")
+	}
+
+	priority := syslogFacilityUser<<syslogFacilityBits | syslogSeverity(entry.Level)
+
+	// Same formats as used by log/syslog
+	var line string
+	if s.local {
+		line = fmt.Sprintf("<%d>%s %s[%d]: %s", priority, entry.Time.Format(time.Stamp), s.tag, os.Getpid(), msg)
+	} else {
+		line = fmt.Sprintf("<%d>%s %s %s[%d]: %s", priority, entry.Time.Format(time.RFC3339), s.hostname, s.tag, os.Getpid(), msg)
+	}
+
+	if s.stream && !strings.HasSuffix(line, "\n") {
+		line += "\n"
+	} else if !s.stream {
+		line = strings.TrimSuffix(line, "\n")
+	}
+
+	_, err = s.conn.Write([]byte(line))
+	return errors.Wrap(err, "sending entry to syslog")
+}
+
+// syslogSeverity maps the log level to the syslog severity also used
+// as journald priority
+func syslogSeverity(l logrus.Level) int {
+	switch l {
+	case logrus.PanicLevel, logrus.FatalLevel:
+		return 2 //nolint:gomnd // LOG_CRIT
+	case logrus.ErrorLevel:
+		return 3 //nolint:gomnd // LOG_ERR
+	case logrus.WarnLevel:
+		return 4 //nolint:gomnd // LOG_WARNING
+	case logrus.InfoLevel:
+		return 6 //nolint:gomnd // LOG_INFO
+	default:
+		return 7 //nolint:gomnd // LOG_DEBUG
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// recordingConn collects the data written to the connection
+type recordingConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (r *recordingConn) Write(p []byte) (int, error) { return r.buf.Write(p) }
+
+var _ = Describe("Logging", func() {
+	var (
+		conn  *recordingConn
+		entry *logrus.Entry
+	)
+
+	BeforeEach(func() {
+		conn = &recordingConn{}
+		entry = &logrus.Entry{
+			Time:    time.Date(2024, 3, 5, 8, 4, 5, 0, time.UTC),
+			Level:   logrus.WarnLevel,
+			Message: "disk is almost full",
+			Data:    logrus.Fields{},
+		}
+	})
+
+	It("should encode entries for journald", func() {
+		entry.Data = logrus.Fields{
+			"error":       errors.New("first\nsecond"),
+			"source-name": "wiki",
+			"_private":    "x",
+			"_":           "dropped",
+		}
+
+		hook := journaldHook{conn: conn, fields: map[string]string{"JOB": "backup"}}
+		Expect(hook.Fire(entry)).To(Succeed())
+
+		var length bytes.Buffer
+		Expect(binary.Write(&length, binary.LittleEndian, uint64(len("first\nsecond")))).To(Succeed())
+
+		Expect(conn.buf.String()).To(Equal("" +
+			"ERROR\n" + length.String() + "first\nsecond\n" +
+			"JOB=backup\n" +
+			"MESSAGE=disk is almost full\n" +
+			"PRIORITY=4\n" +
+			"PRIVATE=x\n" +
+			"SOURCE_NAME=wiki\n",
+		))
+	})
+
+	It("should format syslog lines for local sockets", func() {
+		hook := syslogHook{conn: conn, formatter: &logrus.TextFormatter{DisableTimestamp: true, DisableColors: true}, local: true, tag: "backup"}
+		Expect(hook.Fire(entry)).To(Succeed())
+
+		Expect(conn.buf.String()).To(Equal(fmt.Sprintf(
+			`<12>Mar  5 08:04:05 backup[%d]: level=warning msg="disk is almost full"`, os.Getpid(),
+		)))
+	})
+
+	It("should format syslog lines for remote servers", func() {
+		hook := syslogHook{conn: conn, formatter: &logrus.TextFormatter{DisableTimestamp: true, DisableColors: true}, stream: true, hostname: "host", tag: "backup"}
+		entry.Level = logrus.ErrorLevel
+		Expect(hook.Fire(entry)).To(Succeed())
+
+		Expect(conn.buf.String()).To(Equal(fmt.Sprintf(
+			"<11>2024-03-05T08:04:05Z host backup[%d]: level=error msg=\"disk is almost full\"\n", os.Getpid(),
+		)))
+	})
+})
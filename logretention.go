@@ -0,0 +1,155 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	logFileGlob      = "duplicity-backup_*.txt*"
+	latestLogName    = "latest"
+	logFilePerms     = 0o600
+	bytesPerMebiByte = 1024 * 1024
+
+	// activeLogWindow protects logs of runs started before the lock
+	// holder which are still waiting for the lock or the conditions and
+	// write to their log at least once per conditionRetryInterval
+	activeLogWindow = 2 * conditionRetryInterval
+)
+
+type logRetentionConfig struct {
+	MaxAge         time.Duration `yaml:"max_age"`
+	MaxCount       int           `yaml:"max_count"`
+	MaxTotalSizeMB int64         `yaml:"max_total_size_mb"`
+	Compress       bool          `yaml:"compress"`
+}
+
+// rotateLogs points the latest symlink to the current log, compresses
+// the logs of previous runs and removes logs exceeding the retention.
+// Logs written since shortly before the start of the current run are
+// not touched as they might belong to runs still active. Without log
+// file of the current run the latest symlink is kept.
+func (c *configFile) rotateLogs(current string, started time.Time) error {
+	if current == "" {
+		logrus.Debug("No log file written, keeping latest symlink")
+	} else if err := linkLatestLog(current); err != nil {
+		// Symlinks might not be supported, this is no reason to fail
+		logrus.WithError(err).Warn("linking latest log")
+	}
+
+	logs, err := filepath.Glob(filepath.Join(c.LogDirectory, logFileGlob))
+	if err != nil {
+		return errors.Wrap(err, "listing log files")
+	}
+
+	// Log names contain the start time: newest logs first
+	sort.Sort(sort.Reverse(sort.StringSlice(logs)))
+
+	var (
+		retention = c.LogRetention
+		totalSize int64
+		kept      int
+	)
+
+	for _, l := range logs {
+		if l == current {
+			continue
+		}
+
+		var info os.FileInfo
+		if info, err = os.Stat(l); err != nil {
+			return errors.Wrapf(err, "getting log %q", l)
+		}
+
+		if info.ModTime().After(started.Add(-activeLogWindow)) {
+			continue
+		}
+
+		if retention.Compress && !strings.HasSuffix(l, ".gz") {
+			if l, err = compressLog(l); err != nil {
+				return errors.Wrapf(err, "compressing log %q", l)
+			}
+		}
+
+		if info, err = os.Stat(l); err != nil {
+			return errors.Wrapf(err, "getting log %q", l)
+		}
+
+		totalSize += info.Size()
+		kept++
+
+		if (retention.MaxAge <= 0 || time.Since(info.ModTime()) <= retention.MaxAge) &&
+			(retention.MaxCount <= 0 || kept < retention.MaxCount) &&
+			(retention.MaxTotalSizeMB <= 0 || totalSize <= retention.MaxTotalSizeMB*bytesPerMebiByte) {
+			continue
+		}
+
+		logrus.Debugf("Removing log %q exceeding retention", l)
+		if err = os.Remove(l); err != nil {
+			return errors.Wrapf(err, "removing log %q", l)
+		}
+	}
+
+	return nil
+}
+
+// linkLatestLog replaces the latest symlink in the log directory to
+// point to the given log
+func linkLatestLog(current string) error {
+	latest := filepath.Join(filepath.Dir(current), latestLogName)
+
+	if err := os.Remove(latest); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "removing previous symlink")
+	}
+
+	return errors.Wrap(os.Symlink(filepath.Base(current), latest), "creating symlink")
+}
+
+// compressLog replaces the log with a gzip compressed version keeping
+// its modification time and returns the path of the compressed log
+func compressLog(l string) (string, error) {
+	info, err := os.Stat(l)
+	if err != nil {
+		return l, errors.Wrap(err, "getting log")
+	}
+
+	src, err := os.Open(l) //#nosec:G304 // Path is a log file found in the log directory
+	if err != nil {
+		return l, errors.Wrap(err, "opening log")
+	}
+	defer src.Close() //nolint:errcheck // File is only read
+
+	target := l + ".gz"
+	dst, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, logFilePerms) //#nosec:G304 // Path is derived from the log
+	if err != nil {
+		return l, errors.Wrap(err, "creating compressed log")
+	}
+	defer dst.Close() //nolint:errcheck // Close is checked below
+
+	gz := gzip.NewWriter(dst)
+	if _, err = io.Copy(gz, src); err != nil {
+		return l, errors.Wrap(err, "compressing log")
+	}
+
+	if err = gz.Close(); err != nil {
+		return l, errors.Wrap(err, "finishing compressed log")
+	}
+
+	if err = dst.Close(); err != nil {
+		return l, errors.Wrap(err, "closing compressed log")
+	}
+
+	if err = os.Chtimes(target, info.ModTime(), info.ModTime()); err != nil {
+		return l, errors.Wrap(err, "setting modification time")
+	}
+
+	return target, errors.Wrap(os.Remove(l), "removing uncompressed log")
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Log retention", func() {
+	var (
+		config  *configFile
+		tmp     string
+		current string
+		started time.Time
+	)
+
+	// writeLog creates the log of a run started the given number of days
+	// before the current run
+	writeLog := func(daysAgo int, size int) string {
+		t := started.AddDate(0, 0, -daysAgo)
+		l := filepath.Join(tmp, t.Format("duplicity-backup_2006-01-02_15-04-05.txt"))
+		Expect(os.WriteFile(l, []byte(strings.Repeat("x", size)), 0o600)).To(Succeed())
+		Expect(os.Chtimes(l, t, t)).To(Succeed())
+		return l
+	}
+
+	logNames := func() []string {
+		logs, err := filepath.Glob(filepath.Join(tmp, logFileGlob))
+		Expect(err).NotTo(HaveOccurred())
+
+		var names []string
+		for _, l := range logs {
+			names = append(names, filepath.Base(l))
+		}
+		return names
+	}
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = os.MkdirTemp("", "duplicity-backup-test-")
+		Expect(err).NotTo(HaveOccurred())
+
+		config = &configFile{LogDirectory: tmp}
+		started = time.Now()
+		current = writeLog(0, 1)
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(tmp)).To(Succeed())
+	})
+
+	It("should link the latest log", func() {
+		Expect(config.rotateLogs(current, started)).To(Succeed())
+
+		target, err := os.Readlink(filepath.Join(tmp, latestLogName))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(target).To(Equal(filepath.Base(current)))
+	})
+
+	It("should keep the latest symlink without log file of the run", func() {
+		Expect(config.rotateLogs(current, started)).To(Succeed())
+		Expect(config.rotateLogs("", started.Add(time.Hour))).To(Succeed())
+
+		target, err := os.Readlink(filepath.Join(tmp, latestLogName))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(target).To(Equal(filepath.Base(current)))
+	})
+
+	It("should only write the log file with file output", func() {
+		Expect(config.writesLogFile()).To(BeTrue())
+
+		config.Logging.Outputs = []logOutputConfig{{Type: logOutputJournald}}
+		Expect(config.writesLogFile()).To(BeFalse())
+
+		config.Logging.Outputs = append(config.Logging.Outputs, logOutputConfig{Type: logOutputFile})
+		Expect(config.writesLogFile()).To(BeTrue())
+	})
+
+	It("should keep the newest logs up to the count", func() {
+		old := []string{writeLog(1, 1), writeLog(2, 1), writeLog(3, 1)}
+		config.LogRetention.MaxCount = 3
+
+		Expect(config.rotateLogs(current, started)).To(Succeed())
+		Expect(logNames()).To(ConsistOf(filepath.Base(current), filepath.Base(old[0]), filepath.Base(old[1])))
+	})
+
+	It("should remove logs older than the maximum age", func() {
+		recent := writeLog(1, 1)
+		writeLog(10, 1)
+		config.LogRetention.MaxAge = 5 * 24 * time.Hour
+
+		Expect(config.rotateLogs(current, started)).To(Succeed())
+		Expect(logNames()).To(ConsistOf(filepath.Base(current), filepath.Base(recent)))
+	})
+
+	It("should remove the oldest logs exceeding the total size", func() {
+		recent := writeLog(1, bytesPerMebiByte/2)
+		writeLog(2, bytesPerMebiByte/2+1)
+		config.LogRetention.MaxTotalSizeMB = 1
+
+		Expect(config.rotateLogs(current, started)).To(Succeed())
+		Expect(logNames()).To(ConsistOf(filepath.Base(current), filepath.Base(recent)))
+	})
+
+	It("should compress previous logs keeping their modification time", func() {
+		old := writeLog(1, 10)
+
+		config.LogRetention.Compress = true
+		Expect(config.rotateLogs(current, started)).To(Succeed())
+		Expect(logNames()).To(ConsistOf(filepath.Base(current), filepath.Base(old)+".gz"))
+
+		info, err := os.Stat(old + ".gz")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.ModTime().Unix()).To(Equal(started.AddDate(0, 0, -1).Unix()))
+
+		f, err := os.Open(old + ".gz")
+		Expect(err).NotTo(HaveOccurred())
+		defer f.Close() //nolint:errcheck // Test cleanup
+
+		gz, err := gzip.NewReader(f)
+		Expect(err).NotTo(HaveOccurred())
+		content, err := io.ReadAll(gz)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(content)).To(Equal(strings.Repeat("x", 10)))
+	})
+
+	It("should not touch logs of runs which might still be active", func() {
+		active := filepath.Join(tmp, fmt.Sprintf("duplicity-backup_%s.txt", started.Add(time.Second).Format("2006-01-02_15-04-05")))
+		Expect(os.WriteFile(active, []byte("running"), 0o600)).To(Succeed())
+
+		config.LogRetention.Compress = true
+		config.LogRetention.MaxCount = 1
+
+		Expect(config.rotateLogs(current, started)).To(Succeed())
+		Expect(logNames()).To(ConsistOf(filepath.Base(current), filepath.Base(active)))
+	})
+})
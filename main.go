@@ -3,10 +3,11 @@ package main
 import (
 	_ "embed"
 	"fmt"
+	"io"
 	"os"
-	"os/exec"
 	"path"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -15,7 +16,6 @@ import (
 	"github.com/Luzifer/go_helpers/v2/which"
 	"github.com/Luzifer/rconfig/v2"
 	"github.com/pkg/errors"
-	"github.com/rifflock/lfshook"
 
 	"github.com/mitchellh/go-homedir"
 	"github.com/nightlyone/lockfile"
@@ -29,11 +29,22 @@ const (
 
 var (
 	cfg = struct {
-		ConfigFile string `flag:"config-file,f" default:"~/.config/duplicity-backup.yaml" description:"Configuration for this duplicity wrapper"`
-		LockFile   string `flag:"lock-file,l" default:"~/.config/duplicity-backup.lock" description:"File to hold the lock for this wrapper execution"`
+		ConfigFile string        `flag:"config-file,f" default:"~/.config/duplicity-backup.yaml" description:"Configuration for this duplicity wrapper"`
+		LockFile   string        `flag:"lock-file,l" default:"~/.config/duplicity-backup.lock" description:"File to hold the lock for this wrapper execution"`
+		LockWait   time.Duration `flag:"lock-wait" default:"0s" description:"Time to wait for the lock held by another run before skipping this run"`
 
 		RestoreTime string `flag:"time,t" description:"The time from which to restore or list files"`
+		FilesFrom   string `flag:"files-from" description:"File containing the paths to restore (one per line)"`
 
+		ConflictPolicy string `flag:"conflict" description:"How to handle existing files on restore (skip, overwrite, rename, swap)"`
+
+		DiffFrom     string `flag:"from" description:"The time of the backup to compare from"`
+		DiffTo       string `flag:"to" description:"The time of the backup to compare to (defaults to latest backup)"`
+		OutputFormat string `flag:"format" default:"text" description:"Output format of diff and list-changed-files (text, json, csv)"`
+
+		GracePeriod time.Duration `flag:"grace-period" default:"30s" description:"Time to wait for duplicity to exit after forwarding SIGINT / SIGTERM before killing it"`
+
+		Progress bool   `flag:"progress" default:"false" description:"Report progress of backups (progress bar on a terminal, periodic log lines otherwise)"`
 		DryRun   bool   `flag:"dry-run,n" default:"false" description:"Do a test-run without changes"`
 		Silent   bool   `flag:"silent,s" default:"false" description:"Do not print to stdout, only write to logfile (for example useful for crons)"`
 		LogLevel string `flag:"log-level" default:"info" description:"Verbosity of logs to use (debug, info, warning, error, ...)"`
@@ -52,7 +63,7 @@ var (
 func initApp() error {
 	rconfig.AutoEnv(true)
 	if err := rconfig.Parse(&cfg); err != nil {
-		logrus.WithError(err).Fatal("Error while parsing arguments")
+		return errors.Wrap(err, "parsing CLI options")
 	}
 
 	l, err := logrus.ParseLevel(cfg.LogLevel)
@@ -76,68 +87,118 @@ func initApp() error {
 	return nil
 }
 
-//nolint:gocyclo // Slightly too complex, makes no sense to split
 func main() {
+	os.Exit(run())
+}
+
+// run executes the requested command and returns the exit code for
+// the process so deferred cleanups are executed before exiting
+//
+//nolint:funlen,gocyclo // Slightly too complex, makes no sense to split
+func run() int {
 	var (
 		err    error
 		config *configFile
 	)
 
 	if err = initApp(); err != nil {
-		logrus.WithError(err).Fatal("initializing app")
+		logrus.WithError(err).Error("initializing app")
+		return exitCodeConfig
 	}
 
 	if cfg.VersionAndExit {
 		logrus.WithField("version", version).Info("duplicity-backup")
-		os.Exit(0)
+		return exitCodeSuccess
 	}
 
 	lock, err := lockfile.New(cfg.LockFile)
 	if err != nil {
-		logrus.WithError(err).Fatal("initializing lockfile")
+		logrus.WithError(err).Error("initializing lockfile")
+		return exitCodeConfig
 	}
 
 	// If no command is passed assume we're requesting "help"
 	argv := rconfig.Args()
 	if len(argv) == 1 || argv[1] == "help" {
 		if _, err = os.Stderr.WriteString(helpText); err != nil {
-			logrus.WithError(err).Fatal("printing help to stderr")
+			logrus.WithError(err).Error("printing help to stderr")
+			return exitCodeFailure
 		}
-		return
+		return exitCodeSuccess
+	}
+
+	if argv[1] == commandLock {
+		if len(argv) != 3 || argv[2] != "status" { //nolint:gomnd // lock status
+			logrus.Error("Usage: lock status")
+			return exitCodeFailure
+		}
+
+		if err = runLockStatus(lock); err != nil {
+			logrus.WithError(err).Error("reading lock status")
+			return exitCodeFailure
+		}
+		return exitCodeSuccess
 	}
 
 	// Get configuration
 	configSource, err := os.Open(cfg.ConfigFile)
 	if err != nil {
-		logrus.WithError(err).Fatalf("opening configuration file %s", cfg.ConfigFile)
+		logrus.WithError(err).Errorf("opening configuration file %s", cfg.ConfigFile)
+		return exitCodeConfig
 	}
 	defer configSource.Close() //nolint:errcheck // If this errors the file will be closed by process exit
 
 	config, err = loadConfigFile(configSource)
 	if err != nil {
-		logrus.WithError(err).Fatal("reading configuration file")
+		logrus.WithError(err).Error("reading configuration file")
+		return exitCodeConfig
 	}
 
 	// Initialize logfile
 	if err = os.MkdirAll(config.LogDirectory, logDirPerms); err != nil {
-		logrus.WithError(err).Fatal("creating log dir")
+		logrus.WithError(err).Error("creating log dir")
+		return exitCodeFailure
 	}
 
-	logFilePath := path.Join(config.LogDirectory, time.Now().Format("duplicity-backup_2006-01-02_15-04-05.txt"))
-	logFile, err := os.Create(logFilePath) //#nosec:G304 // That's a log file we just created the path for
-	if err != nil {
-		logrus.WithError(err).Fatalf("opening logfile %s", logFilePath)
+	var (
+		started     = time.Now()
+		logFilePath string
+		logFile     io.Writer = io.Discard
+	)
+
+	if config.writesLogFile() {
+		logFilePath = path.Join(config.LogDirectory, started.Format("duplicity-backup_2006-01-02_15-04-05.txt"))
+		f, err := os.Create(logFilePath) //#nosec:G304 // That's a log file we just created the path for
+		if err != nil {
+			logrus.WithError(err).Errorf("opening logfile %s", logFilePath)
+			return exitCodeFailure
+		}
+		defer f.Close() //nolint:errcheck // If this errors the file will be closed by process exit
+		logFile = f
 	}
-	defer logFile.Close() //nolint:errcheck // If this errors the file will be closed by process exit
 
-	// Hook into logging and write to file
-	logrus.AddHook(lfshook.NewHook(logFile, nil))
+	// Hook into logging and write to file and configured outputs
+	if err = config.setupLogging(logFile, argv[1]); err != nil {
+		logrus.WithError(err).Error("setting up logging")
+	}
 
 	logrus.Infof("++++ duplicity-backup %s started with command '%s'", version, argv[1])
 
-	if err := lock.TryLock(); err != nil {
+	if argv[1] != commandBrowse {
+		// The interactive browser is left using Ctrl+C
+		handleInterrupts()
+	}
+
+	if err := config.checkConditions(argv[1]); err != nil {
+		notifyFailure(config, argv[1], err)
+		logrus.WithError(err).Error("checking conditions")
+		return exitCode(err)
+	}
+
+	if err := acquireLock(lock, argv[1], cfg.LockWait); err != nil {
+		notifyFailure(config, argv[1], err)
 		logrus.WithError(err).Error("acquiring lock")
-		return
+		return exitCode(err)
 	}
 	defer func() {
 		if err = lock.Unlock(); err != nil {
@@ -145,38 +206,234 @@ func main() {
 		}
 	}()
 
-	if err := execute(config, argv[1:]); err != nil {
-		return
+	// Only the lock holder rotates as other runs might still be writing
+	if err = config.rotateLogs(logFilePath, started); err != nil {
+		logrus.WithError(err).Error("rotating logs")
 	}
 
-	if config.Cleanup.Type != "none" && str.StringInSlice(argv[1], removeCommands) {
+	info := hookRunInfo{Command: argv[1], LogFile: logFilePath}
+
+	if info.Err = config.runHooks(hookStagePre, info); info.Err != nil {
+		// Post and failure hooks still run to clean up after the pre
+		// hooks which succeeded
+		notifyFailure(config, argv[1], info.Err)
+	} else {
+		info.Err = runCommand(config, argv[1:])
+	}
+
+	if err := interruptError(); err != nil {
+		logrus.WithError(err).Warn("++++ Backup interrupted")
+	}
+
+	code := exitCode(info.Err)
+
+	stage := hookStageOnSuccess
+	if info.Err != nil {
+		stage = hookStageOnFailure
+	}
+
+	for _, s := range []string{hookStagePost, stage} {
+		if err := config.runHooks(s, info); err != nil && info.Err == nil {
+			// Failures of the command itself are already notified
+			notifyFailure(config, argv[1], err)
+			code = exitCode(err)
+		}
+	}
+
+	if code == exitCodeSuccess && config.notifyFailed {
+		code = exitCodeNotification
+	}
+
+	return code
+}
+
+// runCommand executes the command including the preparations and
+// follow-up tasks belonging to it
+func runCommand(config *configFile, argv []string) error {
+	var details []string
+
+	if config.usesRemoteLock(argv[0]) {
+		lock, err := config.acquireRemoteLock(argv[0])
+		if err != nil {
+			logrus.WithError(err).Error("acquiring remote lock")
+			notifyFailure(config, argv[0], err)
+			return err
+		}
+
+		config.activeRemoteLock = lock
+		defer func() {
+			lock.release()
+			config.activeRemoteLock = nil
+		}()
+	}
+
+	if str.StringInSlice(argv[0], backupCommands) {
+		dumps, err := config.dumpSources()
+		defer config.cleanupDumps()
+
+		for _, d := range dumps {
+			details = append(details, d.String())
+		}
+
+		if err != nil {
+			logrus.WithError(err).Error("dumping sources")
+		} else {
+			err = prepareBackup(config)
+		}
+
+		if err == nil {
+			// Snapshot is created last to contain dumps and canary
+			err = config.createSnapshot()
+			defer config.removeSnapshot()
+		}
+
+		if err != nil {
+			notifyFailure(config, argv[0], err, details...)
+			return err
+		}
+	}
+
+	if err := executeCommand(config, argv, details...); err != nil {
+		return err
+	}
+
+	if config.Cleanup.Type != "none" && str.StringInSlice(argv[0], removeCommands) {
 		logrus.Info("++++ Starting removal of old backups")
 
 		if err := execute(config, []string{commandRemove}); err != nil {
-			return
+			return exitCodeError{code: exitCodeCleanup, err: err}
 		}
 	}
 
-	if err := config.Notify(argv[1], true, nil); err != nil {
+	if config.updateIndexAfterBackup() && !cfg.DryRun && str.StringInSlice(argv[0], backupCommands) {
+		logrus.Info("++++ Updating local index")
+
+		if err := config.updateIndex(); err != nil {
+			// The backup itself succeeded, the index can be updated later
+			logrus.WithError(err).Error("updating index")
+		}
+	}
+
+	if err := config.Notify(argv[0], true, nil, details...); err != nil {
 		logrus.WithError(err).Error("sending notifications")
 	} else {
 		logrus.Info("notifications sent")
 	}
 
+	if config.Canary.Enable && config.Canary.VerifyAfterBackup && !cfg.DryRun && str.StringInSlice(argv[0], backupCommands) {
+		logrus.Info("++++ Verifying canary file")
+
+		if err := runCanaryCheck(config); err != nil {
+			return err
+		}
+
+		if err := config.Notify(commandCheckCanary, true, nil); err != nil {
+			logrus.WithError(err).Error("sending notifications")
+		}
+	}
+
 	logrus.Info("++++ Backup finished successfully")
+	return nil
+}
+
+// notifyFailure sends a failure notification and logs the result
+func notifyFailure(config *configFile, command string, err error, details ...string) {
+	if nErr := config.Notify(command, false, err, details...); nErr != nil {
+		logrus.WithError(nErr).Error("Error sending notifications")
+	} else {
+		logrus.Info("Notifications sent")
+	}
+}
+
+// prepareBackup executes the checks and preparations required before
+// running a backup
+func prepareBackup(config *configFile) error {
+	if err := config.checkChangeGuard(); err != nil {
+		logrus.WithError(err).Error("Backup aborted by change guard")
+		return errors.Wrap(err, "change guard")
+	}
+
+	if err := config.writeCanary(); err != nil {
+		logrus.WithError(err).Error("writing canary file")
+		return errors.Wrap(err, "writing canary file")
+	}
+
+	return nil
+}
+
+// executeCommand dispatches the commands handled by the wrapper itself
+// and hands everything else over to duplicity. The details of the
+// preparations are added to failure notifications of duplicity.
+func executeCommand(config *configFile, argv []string, details ...string) error {
+	switch argv[0] {
+	case commandRestoreTest:
+		return runRestoreTest(config)
+
+	case commandCheckCanary:
+		return runCanaryCheck(config)
+
+	case commandBrowse:
+		return runRestoreBrowser(config)
+
+	case commandRestore:
+		return runRestore(config, argv)
+
+	case commandHistory:
+		return runHistory(config, argv)
+
+	case commandFind:
+		return runFind(config, argv)
+
+	case commandDiff:
+		return runDiff(config)
+
+	case commandListChangedFiles:
+		return runListChangedFiles(config)
+
+	case commandUpdateIndex:
+		return runUpdateIndex(config)
+
+	default:
+		return execute(config, argv, details...)
+	}
 }
 
-func execute(config *configFile, argv []string) error {
+func execute(config *configFile, argv []string, details ...string) error {
+	err := runDuplicity(config, argv, cfg.RestoreTime, nil)
+
+	switch {
+	case err == nil:
+		// Nothing to notify
+
+	case interruptError() != nil:
+		notifyFailure(config, argv[0], errors.Wrap(interruptError(), "backup interrupted"), details...)
+
+	case errors.As(err, new(timeoutError)):
+		// Reported as timeout by the notifiers
+		notifyFailure(config, argv[0], err, details...)
+
+	default:
+		notifyFailure(config, argv[0], fmt.Errorf("creating backup: %s", err), details...)
+	}
+
+	return err
+}
+
+// runDuplicity executes duplicity for the given command. Without a
+// lineHandler the output is logged according to the logFilter of the
+// command, with a lineHandler every line is passed to it instead and
+// only logged in debug level. Warnings and errors are always logged.
+func runDuplicity(config *configFile, argv []string, restoreTime string, lineHandler func(string)) error {
 	var (
 		err                 error
 		commandLine, tmpEnv []string
 		logFilter           *regexp.Regexp
 	)
 
-	commandLine, tmpEnv, logFilter, err = config.GenerateCommand(argv, cfg.RestoreTime)
+	commandLine, tmpEnv, logFilter, err = config.GenerateCommand(argv, restoreTime)
 	if err != nil {
 		logrus.WithError(err).Error("generating command")
-		return err
+		return errors.Wrap(err, "generating command")
 	}
 
 	procEnv := env.ListToMap(os.Environ())
@@ -185,31 +442,53 @@ func execute(config *configFile, argv []string) error {
 	}
 
 	// Ensure duplicity is talking to us
-	commandLine = append([]string{"-v3"}, commandLine...)
+	outputOptions, progress := duplicityOutputOptions(argv[0])
+	commandLine = append(outputOptions, commandLine...)
 
 	if cfg.DryRun {
 		commandLine = append([]string{"--dry-run"}, commandLine...)
 	}
 
-	logrus.Debugf("Command: %s %s", duplicityBinary, strings.Join(commandLine, " "))
+	binary, commandLine, err := config.Throttle.wrapCommand(time.Now(), config.maxRuntime(argv[0]), duplicityBinary, commandLine...)
+	if err != nil {
+		logrus.WithError(err).Error("generating command")
+		return errors.Wrap(err, "generating command")
+	}
+	logrus.Debugf("Command: %s %s", binary, strings.Join(commandLine, " "))
+
+	var (
+		wd         = config.newWatchdog(argv[0])
+		classifier = &outputClassifier{}
+	)
+	defer wd.stop()
 
-	msgChan := make(chan string, messageChanSize)
-	go func(c chan string, logFilter *regexp.Regexp) {
-		for l := range c {
-			if logFilter == nil || logFilter.MatchString(l) {
-				logrus.Info(l)
+	merger := &outputMerger{classifier: classifier, progress: progress, handle: func(l string, level logrus.Level) {
+		if lineHandler != nil {
+			lineHandler(l)
+			if level == logrus.InfoLevel {
+				level = logrus.DebugLevel
 			}
 		}
-	}(msgChan, logFilter)
 
-	output := newMessageChanWriter(msgChan)
-	cmd := exec.Command(duplicityBinary, commandLine...) // #nosec G204
-	cmd.Stdout = output
-	cmd.Stderr = output
+		// Warnings and errors are logged regardless of the filter
+		if level <= logrus.WarnLevel || lineHandler != nil || logFilter == nil || logFilter.MatchString(l) {
+			logrus.StandardLogger().Log(level, l)
+		}
+	}}
+
+	cmd := interruptibleCommand(wd.ctx, binary, commandLine...)
 	cmd.Env = env.MapToList(procEnv)
-	err = cmd.Run()
+	err = merger.runCommand(cmd, wd.seen)
 
-	close(msgChan)
+	if progress != nil {
+		progress.finish()
+	}
+
+	if tErr := wd.err(); tErr != nil {
+		err = tErr
+	} else {
+		err = classifier.wrap(err)
+	}
 
 	if err != nil {
 		logrus.Error("Execution of duplicity command was unsuccessful! (exit-code was non-zero)")
@@ -217,13 +496,19 @@ func execute(config *configFile, argv []string) error {
 		logrus.Info("Execution of duplicity command was successful.")
 	}
 
-	if err != nil {
-		if nErr := config.Notify(argv[0], false, fmt.Errorf("creating backup: %s", err)); nErr != nil {
-			logrus.WithError(err).Error("Error sending notifications")
-		} else {
-			logrus.Info("Notifications sent")
-		}
+	return errors.Wrap(err, "running duplicity")
+}
+
+// duplicityOutputOptions returns the options controlling the output of
+// duplicity and the progress reporter if progress is requested. The log
+// records written to the log fd carry the levels of the messages.
+func duplicityOutputOptions(command string) ([]string, *progressReporter) {
+	logFDOption := "--log-fd=" + strconv.Itoa(logFD)
+
+	if !cfg.Progress || !str.StringInSlice(command, backupCommands) {
+		return []string{"-v3", logFDOption}, nil
 	}
 
-	return errors.Wrap(err, "running duplicity")
+	// Progress is printed with notice verbosity
+	return []string{"-v4", "--progress", logFDOption}, newProgressReporter()
 }
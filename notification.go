@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/Luzifer/go_helpers/v2/str"
@@ -14,18 +15,18 @@ import (
 
 const notifyRequestTimeout = 2 * time.Second
 
-func (c *configFile) Notify(command string, success bool, err error) error {
+func (c *configFile) Notify(command string, success bool, err error, details ...string) error {
 	if !str.StringInSlice(command, notifyCommands) {
 		return nil
 	}
 
 	errs := []error{}
 
-	for _, n := range []func(bool, error) error{
+	for _, n := range []func(string, bool, error, []string) error{
 		c.notifyMonDash,
 		c.notifySlack,
 	} {
-		if e := n(success, err); e != nil {
+		if e := n(command, success, err, details); e != nil {
 			errs = append(errs, e)
 		}
 	}
@@ -34,6 +35,8 @@ func (c *configFile) Notify(command string, success bool, err error) error {
 		return nil
 	}
 
+	c.notifyFailed = true
+
 	estr := ""
 	for _, e := range errs {
 		if e == nil {
@@ -45,6 +48,41 @@ func (c *configFile) Notify(command string, success bool, err error) error {
 	return errors.Errorf("%d notifiers failed:%s", len(errs), estr)
 }
 
+// notifyTopic returns the human readable name of the action performed
+// by the command and a suffix to distinguish its monitoring entries
+func notifyTopic(command string) (topic, idSuffix string) {
+	switch command {
+	case commandRestoreTest:
+		return "Restore test", "-restore-test"
+
+	case commandCheckCanary:
+		return "Canary check", "-canary"
+
+	default:
+		return "Backup", ""
+	}
+}
+
+// notifyText describes the outcome of the command, distinguishing
+// timeouts and skipped runs from other failures
+//
+//revive:disable-next-line:flag-parameter // not a flag parameter
+func notifyText(topic string, success bool, err error) string {
+	switch {
+	case success:
+		return fmt.Sprintf("%s succeeded", topic)
+
+	case errors.As(err, new(timeoutError)):
+		return fmt.Sprintf("%s timed out: %s", topic, err)
+
+	case errors.As(err, new(skippedError)):
+		return fmt.Sprintf("%s skipped: %s", topic, err)
+
+	default:
+		return fmt.Sprintf("%s failed: %s", topic, err)
+	}
+}
+
 type mondashResult struct {
 	Title       string `json:"title"`
 	Description string `json:"description"`
@@ -56,11 +94,13 @@ type mondashResult struct {
 }
 
 //revive:disable-next-line:flag-parameter // not a flag parameter
-func (c *configFile) notifyMonDash(success bool, err error) error {
+func (c *configFile) notifyMonDash(command string, success bool, err error, details []string) error {
 	if c.Notifications.MonDash.BoardURL == "" {
 		return nil
 	}
 
+	topic, idSuffix := notifyTopic(command)
+
 	monitoringResult := mondashResult{
 		Title:     fmt.Sprintf("duplicity-backup on %s", c.Hostname),
 		Freshness: c.Notifications.MonDash.Freshness,
@@ -69,12 +109,18 @@ func (c *configFile) notifyMonDash(success bool, err error) error {
 		HideValue: true,
 	}
 
-	if success {
+	switch {
+	case success:
 		monitoringResult.Status = "OK"
-		monitoringResult.Description = "Backup succeeded"
-	} else {
+	case errors.As(err, new(skippedError)):
+		monitoringResult.Status = "Warning"
+	default:
 		monitoringResult.Status = "Critical"
-		monitoringResult.Description = fmt.Sprintf("Backup failed: %s", err)
+	}
+	monitoringResult.Description = notifyText(topic, success, err)
+
+	if len(details) > 0 {
+		monitoringResult.Description += "\n" + strings.Join(details, "\n")
 	}
 
 	buf := bytes.NewBuffer([]byte{})
@@ -82,9 +128,10 @@ func (c *configFile) notifyMonDash(success bool, err error) error {
 		return errors.Wrap(err, "encoding request payload")
 	}
 
-	url := fmt.Sprintf("%s/duplicity-%s",
+	url := fmt.Sprintf("%s/duplicity-%s%s",
 		c.Notifications.MonDash.BoardURL,
 		c.Hostname,
+		idSuffix,
 	)
 
 	ctx, cancel := context.WithTimeout(context.Background(), notifyRequestTimeout)
@@ -119,14 +166,17 @@ type slackResult struct {
 }
 
 //revive:disable-next-line:flag-parameter // not a flag parameter
-func (c *configFile) notifySlack(success bool, err error) error {
+func (c *configFile) notifySlack(command string, success bool, err error, details []string) error {
 	if c.Notifications.Slack.HookURL == "" {
 		return nil
 	}
 
-	text := "Backup succeeded"
-	if !success {
-		text = fmt.Sprintf("Backup failed: %s", err)
+	topic, _ := notifyTopic(command)
+
+	text := notifyText(topic, success, err)
+
+	if len(details) > 0 {
+		text += "\n" + strings.Join(details, "\n")
 	}
 
 	sr := slackResult{
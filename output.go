@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	maxCollectedErrorLines = 20
+	maxCapturedLines       = 200
+
+	// logFD is the file descriptor duplicity writes its log records to,
+	// the first of the extra files passed to the command
+	logFD = 3
+	// outputMatchWindow is the time the console output and the log
+	// records of the same message are expected to arrive within
+	outputMatchWindow = time.Second
+	logFDDrainTimeout = 5 * time.Second
+	maxLogRecordLine  = 1024 * 1024
+)
+
+var (
+	// Fallback for console output not being part of a log record
+	outputErrorLine   = regexp.MustCompile(`(?i)^(error|fatal|critical)\b|^giving up after \d+ attempts|^\w+(Error|Exception): `)
+	outputWarningLine = regexp.MustCompile(`(?i)^warning\b|^attempt \d+ failed`)
+	outputTraceback   = "Traceback (most recent call last):"
+
+	// logRecordStart matches the first line of a record written to the
+	// log fd: the level name followed by the message code
+	logRecordStart = regexp.MustCompile(`^(DEBUG|INFO|NOTICE|WARNING|ERROR)(?: \d+.*)?$`)
+
+	logRecordLevels = map[string]logrus.Level{
+		"DEBUG":   logrus.DebugLevel,
+		"INFO":    logrus.InfoLevel,
+		"NOTICE":  logrus.InfoLevel,
+		"WARNING": logrus.WarnLevel,
+		"ERROR":   logrus.ErrorLevel,
+	}
+)
+
+type (
+	// outputClassifier assigns log levels to the lines printed by
+	// duplicity and collects the lines describing errors as well as
+	// the last lines of the output for diagnostics
+	outputClassifier struct {
+		inTraceback bool
+		errorLines  []string
+		lines       []string
+	}
+
+	// logRecordLine is a message line of a log record written by
+	// duplicity to the log fd
+	logRecordLine struct {
+		text  string
+		level logrus.Level
+	}
+
+	// outputMerger combines the log records of duplicity with its
+	// console output. Every record is printed to the console as well,
+	// lines only found in the console output (like output of the
+	// backends) are classified by their content.
+	outputMerger struct {
+		classifier *outputClassifier
+		progress   *progressReporter
+		handle     func(line string, level logrus.Level)
+
+		console []pendingLine
+		records []pendingLine
+	}
+
+	pendingLine struct {
+		text string
+		at   time.Time
+	}
+
+	// duplicityError carries the error lines printed by duplicity and
+	// the diagnosed causes in addition to its exit status
+	duplicityError struct {
+		err       error
+		lines     []string
+		diagnoses []diagnosis
+	}
+)
+
+func (d duplicityError) Error() string {
+	msg := d.err.Error()
+	if len(d.lines) > 0 {
+		msg += ":\n" + strings.Join(d.lines, "\n")
+	}
+
+	for _, diag := range d.diagnoses {
+		msg += "\n" + diag.String()
+	}
+
+	return msg
+}
+
+func (d duplicityError) Unwrap() error { return d.err }
+
+// classify returns the log level for console output not being part of
+// a log record. Python tracebacks are detected as a whole up to the
+// line containing the exception.
+func (o *outputClassifier) classify(line string) logrus.Level {
+	o.capture(line)
+
+	if inTraceback, exception := o.traceback(line); inTraceback {
+		if exception {
+			o.collect(line)
+		}
+		return logrus.ErrorLevel
+	}
+
+	switch {
+	case outputErrorLine.MatchString(line):
+		o.collect(line)
+		return logrus.ErrorLevel
+
+	case outputWarningLine.MatchString(line):
+		return logrus.WarnLevel
+
+	default:
+		return logrus.InfoLevel
+	}
+}
+
+// record handles a line of a log record and returns the level of the
+// record. Lines of error records are collected except for the stack
+// frames of tracebacks.
+func (o *outputClassifier) record(line string, level logrus.Level) logrus.Level {
+	o.capture(line)
+
+	inTraceback, exception := o.traceback(line)
+	if level == logrus.ErrorLevel && (!inTraceback || exception) {
+		o.collect(line)
+	}
+
+	return level
+}
+
+// traceback tracks Python tracebacks and reports whether the line is
+// part of one and whether it is the line naming the exception
+func (o *outputClassifier) traceback(line string) (inTraceback, exception bool) {
+	switch {
+	case strings.HasPrefix(line, outputTraceback):
+		o.inTraceback = true
+		return true, false
+
+	case o.inTraceback && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")):
+		// Stack frames are only useful in the log
+		return true, false
+
+	case o.inTraceback:
+		o.inTraceback = false
+		return true, true
+
+	default:
+		return false, false
+	}
+}
+
+func (o *outputClassifier) capture(line string) {
+	o.lines = append(o.lines, line)
+	if len(o.lines) > maxCapturedLines {
+		o.lines = o.lines[1:]
+	}
+}
+
+func (o *outputClassifier) collect(line string) {
+	o.errorLines = append(o.errorLines, strings.TrimSpace(line))
+	if len(o.errorLines) > maxCollectedErrorLines {
+		o.errorLines = o.errorLines[1:]
+	}
+}
+
+// wrap attaches the collected error lines and the diagnosed causes of
+// the failure to the error
+func (o *outputClassifier) wrap(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	diagnoses := diagnose(o.lines)
+	for _, d := range diagnoses {
+		logrus.WithField("hint", d.Hint).Errorf("Diagnosed cause of failure: %s", d.Cause)
+	}
+
+	return duplicityError{err: err, lines: o.errorLines, diagnoses: diagnoses}
+}
+
+// readLogRecords parses the records duplicity writes to the log fd: a
+// line with level and message code followed by the message lines
+// prefixed with ". " and an empty line
+func readLogRecords(r io.Reader, lines chan<- logRecordLine) {
+	defer close(lines)
+
+	var (
+		scanner  = bufio.NewScanner(r)
+		level    logrus.Level
+		inRecord bool
+	)
+	scanner.Buffer(nil, maxLogRecordLine)
+
+	for scanner.Scan() {
+		l := scanner.Text()
+
+		switch match := logRecordStart.FindStringSubmatch(l); {
+		case !inRecord && match != nil:
+			level, inRecord = logRecordLevels[match[1]], true
+
+		case inRecord && l == "":
+			inRecord = false
+
+		case inRecord && (l == "." || strings.HasPrefix(l, ". ")):
+			lines <- logRecordLine{text: strings.TrimPrefix(l[1:], " "), level: level}
+		}
+	}
+
+	if err := scanner.Err(); err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+		logrus.WithError(err).Error("reading duplicity log records")
+	}
+}
+
+// run processes the console output and the log records until both
+// channels are closed
+func (m *outputMerger) run(console <-chan string, records <-chan logRecordLine, seen func()) {
+	ticker := time.NewTicker(outputMatchWindow / 4) //nolint:gomnd // Check several times per window
+	defer ticker.Stop()
+
+	for console != nil || records != nil {
+		select {
+		case l, ok := <-console:
+			if !ok {
+				console = nil
+				continue
+			}
+			seen()
+			m.addConsole(l, time.Now())
+
+		case r, ok := <-records:
+			if !ok {
+				records = nil
+				continue
+			}
+			seen()
+			m.addRecord(r, time.Now())
+
+		case now := <-ticker.C:
+			m.expire(now)
+		}
+	}
+
+	m.expire(time.Now().Add(outputMatchWindow))
+}
+
+// addConsole holds back console output until it is known whether the
+// line is part of a log record
+func (m *outputMerger) addConsole(line string, now time.Time) {
+	if i := findPending(m.records, outputKey(line)); i >= 0 {
+		m.records = append(m.records[:i], m.records[i+1:]...)
+		return
+	}
+
+	m.console = append(m.console, pendingLine{text: line, at: now})
+}
+
+// addRecord processes the record line and drops the console output of
+// the same line
+func (m *outputMerger) addRecord(r logRecordLine, now time.Time) {
+	if i := findPending(m.console, outputKey(r.text)); i >= 0 {
+		m.console = append(m.console[:i], m.console[i+1:]...)
+	} else {
+		m.records = append(m.records, pendingLine{text: outputKey(r.text), at: now})
+	}
+
+	m.process(r.text, func(l string) logrus.Level { return m.classifier.record(l, r.level) })
+}
+
+// expire processes console output not matched by a record within the
+// match window
+func (m *outputMerger) expire(now time.Time) {
+	for len(m.console) > 0 && now.Sub(m.console[0].at) >= outputMatchWindow {
+		l := m.console[0].text
+		m.console = m.console[1:]
+		m.process(l, m.classifier.classify)
+	}
+
+	for len(m.records) > 0 && now.Sub(m.records[0].at) >= outputMatchWindow {
+		m.records = m.records[1:]
+	}
+}
+
+func (m *outputMerger) process(line string, level func(string) logrus.Level) {
+	if m.progress != nil && m.progress.handle(line) {
+		return
+	}
+
+	m.handle(line, level(line))
+}
+
+// outputKey normalizes lines for matching console output and records:
+// progress updates might be separated by carriage returns
+func outputKey(line string) string {
+	return strings.TrimSpace(line[strings.LastIndex(line, "\r")+1:])
+}
+
+func findPending(pending []pendingLine, key string) int {
+	for i, p := range pending {
+		if outputKey(p.text) == key {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// runCommand executes the command passing the write end of a pipe as
+// log fd and processes its output until the command exited
+func (m *outputMerger) runCommand(cmd *exec.Cmd, seen func()) error {
+	logR, logW, err := os.Pipe()
+	if err != nil {
+		return errors.Wrap(err, "creating log pipe")
+	}
+	defer logR.Close() //nolint:errcheck // Pipe is only read
+
+	var (
+		console = make(chan string, messageChanSize)
+		records = make(chan logRecordLine, messageChanSize)
+		done    = make(chan struct{})
+	)
+
+	go readLogRecords(logR, records)
+	go func() {
+		defer close(done)
+		m.run(console, records, seen)
+	}()
+
+	output := newMessageChanWriter(console)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	cmd.ExtraFiles = []*os.File{logW} // First extra file is logFD
+
+	err = cmd.Start()
+	logW.Close() //nolint:errcheck,gosec // Only the command writes to the pipe
+	if err == nil {
+		err = cmd.Wait()
+	}
+
+	// Subprocesses of duplicity might still hold the log fd open
+	logR.SetReadDeadline(time.Now().Add(logFDDrainTimeout)) //nolint:errcheck,gosec // Without deadline reading ends on EOF
+
+	close(console)
+	<-done
+
+	// Exit status is wrapped by the caller together with the output
+	return err
+}
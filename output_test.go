@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Duplicity output classification", func() {
+	It("should map lines to log levels and collect errors", func() {
+		var (
+			c      = &outputClassifier{}
+			levels []logrus.Level
+		)
+
+		for _, l := range []string{
+			"Local and Remote metadata are synchronized, no sync needed.",
+			"Warning, found incomplete backup sets, probably left from aborted session",
+			"Attempt 1 failed. BackendException: Connection timed out",
+			"Traceback (most recent call last):",
+			`  File "/usr/bin/duplicity", line 87, in <module>`,
+			"    with_tempdir(main)",
+			"BackendException: Connection timed out",
+			"Giving up after 5 attempts.",
+			"Last full backup date: none",
+		} {
+			levels = append(levels, c.classify(l))
+		}
+
+		Expect(levels).To(Equal([]logrus.Level{
+			logrus.InfoLevel,
+			logrus.WarnLevel,
+			logrus.WarnLevel,
+			logrus.ErrorLevel,
+			logrus.ErrorLevel,
+			logrus.ErrorLevel,
+			logrus.ErrorLevel,
+			logrus.ErrorLevel,
+			logrus.InfoLevel,
+		}))
+
+		Expect(c.wrap(errors.New("exit status 23")).Error()).To(HavePrefix(
+			"exit status 23:\nBackendException: Connection timed out\nGiving up after 5 attempts.\nCause: ",
+		))
+	})
+})
+
+var _ = Describe("Duplicity log records", func() {
+	It("should parse the records written to the log fd", func() {
+		lines := make(chan logRecordLine, 10)
+		readLogRecords(strings.NewReader(
+			"NOTICE 1\n. Local and Remote metadata are synchronized\n\n"+
+				"WARNING 2\n. Found incomplete backup set\n.\n. Second line\n\n"+
+				"ERROR 50 BackendException\n. Giving up after 5 attempts\n\n",
+		), lines)
+
+		var records []logRecordLine
+		for l := range lines {
+			records = append(records, l)
+		}
+
+		Expect(records).To(Equal([]logRecordLine{
+			{text: "Local and Remote metadata are synchronized", level: logrus.InfoLevel},
+			{text: "Found incomplete backup set", level: logrus.WarnLevel},
+			{text: "", level: logrus.WarnLevel},
+			{text: "Second line", level: logrus.WarnLevel},
+			{text: "Giving up after 5 attempts", level: logrus.ErrorLevel},
+		}))
+	})
+
+	It("should prefer the record levels over the console output", func() {
+		var (
+			now     = time.Now()
+			handled []logRecordLine
+			m       = &outputMerger{
+				classifier: &outputClassifier{},
+				handle: func(l string, level logrus.Level) {
+					handled = append(handled, logRecordLine{text: l, level: level})
+				},
+			}
+		)
+
+		// Console output arriving before and after its record is dropped
+		m.addConsole("Error that is only a notice", now)
+		m.addRecord(logRecordLine{text: "Error that is only a notice", level: logrus.InfoLevel}, now)
+		m.addRecord(logRecordLine{text: "Giving up after 5 attempts", level: logrus.ErrorLevel}, now)
+		m.addConsole("Giving up after 5 attempts", now)
+
+		// Output of subprocesses is classified by its content
+		m.addConsole("Error: connection refused", now)
+		m.expire(now)
+		Expect(handled).To(HaveLen(2))
+		m.expire(now.Add(outputMatchWindow))
+
+		Expect(handled).To(Equal([]logRecordLine{
+			{text: "Error that is only a notice", level: logrus.InfoLevel},
+			{text: "Giving up after 5 attempts", level: logrus.ErrorLevel},
+			{text: "Error: connection refused", level: logrus.ErrorLevel},
+		}))
+		Expect(m.classifier.errorLines).To(Equal([]string{"Giving up after 5 attempts", "Error: connection refused"}))
+	})
+})
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	progressBarWidth    = 30
+	progressLogInterval = 5 * time.Minute
+)
+
+// progressLine matches the progress printed by duplicity --progress:
+// 1.4GB 00:06:06 [4.0MB/s] [=====>         ] 13% ETA 40min
+var progressLine = regexp.MustCompile(`^([\d.]+[KMGT]?B) (\d+:\d{2}:\d{2}) \[([\d.]+[KMGT]?B/s)\] \[=*>? *\] (\d+)% ETA (.+)$`)
+
+// progressReporter renders the progress of duplicity as progress bar
+// on a terminal or as periodic log lines when not interactive
+type progressReporter struct {
+	out      io.Writer
+	tty      bool
+	lastLog  time.Time
+	rendered bool
+}
+
+func newProgressReporter() *progressReporter {
+	p := &progressReporter{out: os.Stderr}
+
+	if info, err := os.Stderr.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 && !cfg.Silent {
+		p.tty = true
+	}
+
+	return p
+}
+
+// handle processes progress lines and reports whether the line was one
+func (p *progressReporter) handle(line string) bool {
+	// Only the last update is relevant when updates are separated by
+	// carriage returns instead of newlines
+	line = line[strings.LastIndex(line, "\r")+1:]
+
+	match := progressLine.FindStringSubmatch(strings.TrimSpace(line))
+	if match == nil {
+		return false
+	}
+
+	var (
+		transferred, elapsed, speed, eta = match[1], match[2], match[3], match[5]
+		percent, _                       = strconv.Atoi(match[4]) // #nosec G104 // Regex ensures this is a number
+	)
+
+	if p.tty {
+		done := percent * progressBarWidth / 100 //nolint:gomnd // Percent
+		if done > progressBarWidth {
+			done = progressBarWidth
+		}
+
+		fmt.Fprintf(p.out, "\r\033[K[%s%s] %3d%%  %s  %s  %s  ETA %s",
+			strings.Repeat("#", done), strings.Repeat("-", progressBarWidth-done),
+			percent, transferred, elapsed, speed, eta)
+		p.rendered = true
+		return true
+	}
+
+	if time.Since(p.lastLog) >= progressLogInterval {
+		logrus.WithFields(logrus.Fields{
+			"percent":     percent,
+			"transferred": transferred,
+			"elapsed":     elapsed,
+			"speed":       speed,
+			"eta":         eta,
+		}).Infof("Progress: %d%% (%s transferred at %s, ETA %s)", percent, transferred, speed, eta)
+		p.lastLog = time.Now()
+	}
+
+	return true
+}
+
+// finish moves the output past the progress bar
+func (p *progressReporter) finish() {
+	if p.rendered {
+		fmt.Fprintln(p.out)
+	}
+}
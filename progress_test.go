@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Progress", func() {
+	const update = "1.4GB 00:06:06 [4.0MB/s] [=====>                        ] 13% ETA 40min"
+
+	It("should match the progress lines of duplicity", func() {
+		Expect(progressLine.FindStringSubmatch(update)).To(Equal([]string{update, "1.4GB", "00:06:06", "4.0MB/s", "13", "40min"}))
+		Expect(progressLine.MatchString("0.0B 00:00:01 [0.0B/s] [>                                       ] 0% ETA Stalled!")).To(BeTrue())
+		Expect(progressLine.MatchString("Local and Remote metadata are synchronized, no sync needed.")).To(BeFalse())
+	})
+
+	It("should render the last update as progress bar", func() {
+		var buf bytes.Buffer
+		p := &progressReporter{out: &buf, tty: true}
+
+		Expect(p.handle("Copying files")).To(BeFalse())
+		Expect(buf.Len()).To(BeZero())
+
+		Expect(p.handle("0.0B 00:00:01 [0.0B/s] [>   ] 0% ETA Stalled!\r" + update + "  ")).To(BeTrue())
+		Expect(buf.String()).To(Equal("\r\033[K[###---------------------------]  13%  1.4GB  00:06:06  4.0MB/s  ETA 40min"))
+
+		p.finish()
+		Expect(buf.String()).To(HaveSuffix("\n"))
+	})
+
+	It("should log the progress periodically without terminal", func() {
+		var buf bytes.Buffer
+		p := &progressReporter{out: &buf}
+
+		Expect(p.handle(update)).To(BeTrue())
+		Expect(p.lastLog).To(BeTemporally("~", time.Now(), time.Second))
+
+		logged := p.lastLog
+		Expect(p.handle(update)).To(BeTrue())
+		Expect(p.lastLog).To(Equal(logged))
+
+		p.finish()
+		Expect(buf.Len()).To(BeZero())
+	})
+})
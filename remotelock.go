@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Luzifer/go_helpers/v2/str"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultRemoteLockName      = "duplicity-backup.lock"
+	defaultRemoteLockTTL       = 30 * time.Minute
+	remoteLockHeartbeatsPerTTL = 3
+	remoteLockFilePerms        = 0o600
+	remoteLockDirPerms         = 0o700
+	remoteLockCommandTimeout   = time.Minute
+	remoteLockSSHExitConflict  = 3
+	remoteLockSSHExitNotExist  = 4
+	sshExitConnectionError     = 255
+)
+
+// errRemoteLockConflict is returned by the backends when the lock
+// already exists on create or was changed since it was read
+var errRemoteLockConflict = errors.New("remote lock was changed by someone else")
+
+type (
+	remoteLockConfig struct {
+		Enable     bool          `yaml:"enable"`
+		Name       string        `yaml:"name"`
+		TTL        time.Duration `yaml:"ttl"`
+		Heartbeat  time.Duration `yaml:"heartbeat"`
+		S3Endpoint string        `yaml:"s3_endpoint"`
+		S3Region   string        `yaml:"s3_region"`
+	}
+
+	// remoteLockBackend stores the lock at the destination. Versions
+	// identify the content last read or written to only modify the
+	// lock if nobody else changed it in between.
+	remoteLockBackend interface {
+		create(content []byte) (version string, err error)
+		read() (content []byte, version string, err error)
+		replace(content []byte, version string) (newVersion string, err error)
+		remove(version string) error
+	}
+
+	// remoteLockLostError is returned when the remote lock was taken
+	// over or could not be refreshed in time while the command ran
+	remoteLockLostError struct {
+		reason string
+	}
+
+	remoteLockInfo struct {
+		lockInfo
+		Heartbeat time.Time `json:"heartbeat"`
+		Expires   time.Time `json:"expires"`
+	}
+
+	// remoteLock is a lock held at the destination which is refreshed
+	// until released. Its context is cancelled when the lock is lost.
+	remoteLock struct {
+		backend   remoteLockBackend
+		info      remoteLockInfo
+		version   string
+		ttl       time.Duration
+		takenOver bool
+
+		ctx    context.Context
+		cancel context.CancelCauseFunc
+		stop   chan struct{}
+		done   chan struct{}
+	}
+
+	fileLockBackend struct {
+		path string
+	}
+
+	sshLockBackend struct {
+		host string
+		port string
+		path string
+	}
+)
+
+// remoteLockCommands are the commands writing to the destination and
+// therefore protected by the remote lock
+var remoteLockCommands = []string{
+	commandBackup,
+	commandFullBackup,
+	commandIncrBackup,
+	commandCleanup,
+}
+
+func (r remoteLockLostError) Error() string { return r.reason }
+
+// acquireRemoteLock creates the lock at the destination. An existing
+// lock is only taken over when its holder did not refresh it within
+// its TTL.
+func (c *configFile) acquireRemoteLock(command string) (*remoteLock, error) {
+	backend, err := c.remoteLockBackend()
+	if err != nil {
+		return nil, errors.Wrap(err, "initializing remote lock")
+	}
+
+	if b, ok := backend.(sshLockBackend); ok {
+		if err = b.checkShell(); err != nil {
+			return nil, errors.Wrap(err, "initializing remote lock")
+		}
+	}
+
+	l := &remoteLock{
+		backend: backend,
+		info: remoteLockInfo{lockInfo: lockInfo{
+			PID:      os.Getpid(),
+			Hostname: c.Hostname,
+			Command:  command,
+			Started:  time.Now(),
+		}},
+		ttl:  c.RemoteLock.TTL,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	l.ctx, l.cancel = context.WithCancelCause(interruptCtx)
+
+	if l.ttl <= 0 {
+		l.ttl = defaultRemoteLockTTL
+	}
+
+	content, err := l.content()
+	if err != nil {
+		return nil, err
+	}
+
+	l.version, err = backend.create(content)
+	if errors.Is(err, errRemoteLockConflict) {
+		l.version, err = l.takeOver(content)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "creating remote lock")
+	}
+
+	heartbeat := c.RemoteLock.Heartbeat
+	if heartbeat <= 0 {
+		heartbeat = l.ttl / remoteLockHeartbeatsPerTTL
+	}
+	go l.refresh(heartbeat)
+
+	logrus.Debug("Remote lock acquired")
+	return l, nil
+}
+
+// takeOver replaces an existing lock if it is expired
+func (l *remoteLock) takeOver(content []byte) (string, error) {
+	existing, version, err := l.backend.read()
+	if err != nil {
+		return "", errors.Wrap(err, "reading existing lock")
+	}
+
+	var holder remoteLockInfo
+	if err = json.Unmarshal(existing, &holder); err != nil {
+		return "", errors.Wrap(err, "decoding existing lock")
+	}
+
+	if time.Now().Before(holder.Expires) {
+		return "", skippedError{reason: fmt.Sprintf("destination is locked by %s", holder)}
+	}
+
+	logrus.Warnf("Taking over remote lock of %s expired at %s", holder, holder.Expires.Format(time.RFC3339))
+	return l.backend.replace(content, version)
+}
+
+// refresh updates the expiry of the lock until the lock is released.
+// If the lock was taken over or will expire before the next refresh the
+// lock is considered lost and its context is cancelled.
+func (l *remoteLock) refresh(interval time.Duration) {
+	defer close(l.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	expires := l.info.Expires
+
+	for {
+		select {
+		case <-l.stop:
+			return
+
+		case <-ticker.C:
+			content, err := l.content()
+			if err == nil {
+				var version string
+				if version, err = l.backend.replace(content, l.version); err == nil {
+					l.version = version
+					expires = l.info.Expires
+					continue
+				}
+			}
+
+			switch {
+			case errors.Is(err, errRemoteLockConflict):
+				l.takenOver = true
+				l.lose("remote lock was taken over by another run")
+				return
+
+			case time.Now().Add(interval).After(expires):
+				l.lose(fmt.Sprintf("remote lock expires at %s and could not be refreshed: %s", expires.Format(time.RFC3339), err))
+				return
+			}
+
+			logrus.WithError(err).Error("refreshing remote lock")
+		}
+	}
+}
+
+func (l *remoteLock) lose(reason string) {
+	logrus.Errorf("Stopping command: %s", reason)
+	l.cancel(remoteLockLostError{reason: reason})
+}
+
+// release stops the refresh and removes the lock from the destination
+// unless it was taken over by another run
+func (l *remoteLock) release() {
+	if l == nil {
+		return
+	}
+
+	close(l.stop)
+	<-l.done
+	defer l.cancel(nil)
+
+	if l.takenOver {
+		return
+	}
+
+	if err := l.backend.remove(l.version); err != nil {
+		logrus.WithError(err).Error("releasing remote lock")
+	}
+}
+
+func (l *remoteLock) content() ([]byte, error) {
+	l.info.Heartbeat = time.Now()
+	l.info.Expires = l.info.Heartbeat.Add(l.ttl)
+
+	content, err := json.Marshal(l.info)
+	return content, errors.Wrap(err, "encoding remote lock")
+}
+
+// remoteLockBackend selects the backend storing the lock according to
+// the scheme of the destination
+func (c *configFile) remoteLockBackend() (remoteLockBackend, error) {
+	u, err := url.Parse(c.Destination)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing destination")
+	}
+
+	name := c.RemoteLock.Name
+	if name == "" {
+		name = defaultRemoteLockName
+	}
+
+	// Backend prefixes like "pexpect+" or "paramiko+" are not relevant
+	scheme := u.Scheme
+	if _, s, found := strings.Cut(scheme, "+"); found && scheme != "s3+http" && scheme != "boto3+s3" {
+		scheme = s
+	}
+
+	switch scheme {
+	case "file":
+		return fileLockBackend{path: filepath.Join(filepath.FromSlash(u.Path), name)}, nil
+
+	case "sftp", "ssh", "scp":
+		// Lock is managed using shell commands, not the SFTP protocol
+		host := u.Hostname()
+		if u.User != nil {
+			host = u.User.Username() + "@" + host
+		}
+
+		// Paths are relative to the home directory unless starting
+		// with a double slash
+		return sshLockBackend{
+			host: host,
+			port: u.Port(),
+			path: path.Join(strings.TrimPrefix(u.Path, "/"), name),
+		}, nil
+
+	case "s3", "s3+http", "boto3+s3":
+		return c.s3LockBackend(u, name)
+
+	default:
+		return nil, errors.Errorf("remote lock is not supported for %q destinations", u.Scheme)
+	}
+}
+
+func lockVersion(content []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(content))
+}
+
+func (f fileLockBackend) create(content []byte) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(f.path), remoteLockDirPerms); err != nil {
+		return "", errors.Wrap(err, "creating lock directory")
+	}
+
+	lf, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, remoteLockFilePerms)
+	if os.IsExist(err) {
+		return "", errRemoteLockConflict
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "creating lock file")
+	}
+	defer lf.Close() //nolint:errcheck // Close is checked below
+
+	if _, err = lf.Write(content); err != nil {
+		return "", errors.Wrap(err, "writing lock file")
+	}
+
+	return lockVersion(content), errors.Wrap(lf.Close(), "closing lock file")
+}
+
+func (f fileLockBackend) read() ([]byte, string, error) {
+	content, err := os.ReadFile(f.path)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "reading lock file")
+	}
+
+	return content, lockVersion(content), nil
+}
+
+func (f fileLockBackend) replace(content []byte, version string) (string, error) {
+	if err := f.checkVersion(version); err != nil {
+		return "", err
+	}
+
+	tmp := f.path + ".tmp"
+	if err := os.WriteFile(tmp, content, remoteLockFilePerms); err != nil {
+		return "", errors.Wrap(err, "writing lock file")
+	}
+
+	return lockVersion(content), errors.Wrap(os.Rename(tmp, f.path), "moving lock file into place")
+}
+
+func (f fileLockBackend) remove(version string) error {
+	if err := f.checkVersion(version); err != nil {
+		return err
+	}
+
+	return errors.Wrap(os.Remove(f.path), "removing lock file")
+}
+
+func (f fileLockBackend) checkVersion(version string) error {
+	_, current, err := f.read()
+	if err != nil {
+		return err
+	}
+
+	if current != version {
+		return errRemoteLockConflict
+	}
+
+	return nil
+}
+
+func (s sshLockBackend) create(content []byte) (string, error) {
+	if _, err := s.run(content, fmt.Sprintf(
+		`mkdir -p %[1]s && set -C && if cat >%[2]s 2>/dev/null; then exit 0; fi; [ -e %[2]s ] && exit %[3]d; exit 1`,
+		shellQuote(path.Dir(s.path)), shellQuote(s.path), remoteLockSSHExitConflict,
+	)); err != nil {
+		return "", err
+	}
+
+	return lockVersion(content), nil
+}
+
+func (s sshLockBackend) read() ([]byte, string, error) {
+	content, err := s.run(nil, fmt.Sprintf(`[ -e %[1]s ] || exit %[2]d; cat %[1]s`, shellQuote(s.path), remoteLockSSHExitNotExist))
+	if err != nil {
+		return nil, "", err
+	}
+
+	return content, lockVersion(content), nil
+}
+
+func (s sshLockBackend) replace(content []byte, version string) (string, error) {
+	if _, err := s.run(content, s.checkVersion(version)+fmt.Sprintf(
+		`cat >%[1]s.tmp && mv %[1]s.tmp %[1]s`, shellQuote(s.path),
+	)); err != nil {
+		return "", err
+	}
+
+	return lockVersion(content), nil
+}
+
+func (s sshLockBackend) remove(version string) error {
+	_, err := s.run(nil, s.checkVersion(version)+fmt.Sprintf(`rm -f %s`, shellQuote(s.path)))
+	return err
+}
+
+// checkVersion returns a shell snippet exiting with the conflict exit
+// code if the content of the lock does not match the version
+func (s sshLockBackend) checkVersion(version string) string {
+	return fmt.Sprintf(`[ "$(cat %s 2>/dev/null | sha256sum | cut -d ' ' -f 1)" = %s ] || exit %d; `,
+		shellQuote(s.path), shellQuote(version), remoteLockSSHExitConflict)
+}
+
+// checkShell ensures the tools used by the lock scripts are available
+// on the host as SFTP-only or chrooted accounts cannot run them
+func (s sshLockBackend) checkShell() error {
+	_, err := s.run(nil, `for c in mkdir cat mv rm sha256sum cut; do command -v "$c" >/dev/null || { echo "$c not found" >&2; exit 1; }; done`)
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == sshExitConnectionError {
+		return errors.Wrap(err, "connecting to lock host")
+	}
+
+	return errors.Wrap(err, "remote lock requires a shell providing mkdir, cat, mv, rm, sha256sum and cut")
+}
+
+// run executes the script on the remote host using the ssh binary
+// which needs to be able to log in without password
+func (s sshLockBackend) run(stdin []byte, script string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), remoteLockCommandTimeout)
+	defer cancel()
+
+	args := []string{"-o", "BatchMode=yes"}
+	if s.port != "" {
+		args = append(args, "-p", s.port)
+	}
+	args = append(args, s.host, script)
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "ssh", args...) // #nosec G204 // Intended to run remote commands
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return stdout.Bytes(), nil
+
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == remoteLockSSHExitConflict:
+		return nil, errRemoteLockConflict
+
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == remoteLockSSHExitNotExist:
+		return nil, errors.Wrap(os.ErrNotExist, "reading lock file")
+
+	default:
+		return nil, errors.Wrapf(err, "executing ssh: %s", strings.TrimSpace(stderr.String()))
+	}
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// usesRemoteLock tells whether the command needs to hold the remote lock
+func (c *configFile) usesRemoteLock(command string) bool {
+	return c.RemoteLock.Enable && !cfg.DryRun && str.StringInSlice(command, remoteLockCommands)
+}
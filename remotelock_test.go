@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Remote lock", func() {
+	var (
+		config *configFile
+		tmp    string
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = os.MkdirTemp("", "duplicity-backup-test-")
+		Expect(err).NotTo(HaveOccurred())
+
+		config = &configFile{Hostname: "test", Destination: "file://" + tmp}
+		config.RemoteLock.Enable = true
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(tmp)).To(Succeed())
+	})
+
+	It("should skip while the lock is held and remove it on release", func() {
+		lock, err := config.acquireRemoteLock(commandBackup)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(filepath.Join(tmp, defaultRemoteLockName)).To(BeARegularFile())
+
+		_, err = config.acquireRemoteLock(commandBackup)
+		Expect(err).To(MatchError(ContainSubstring("destination is locked by")))
+		Expect(exitCode(err)).To(Equal(exitCodeLockBusy))
+
+		lock.release()
+		Expect(filepath.Join(tmp, defaultRemoteLockName)).NotTo(BeAnExistingFile())
+	})
+
+	It("should take over an expired lock", func() {
+		content, err := json.Marshal(remoteLockInfo{
+			lockInfo: lockInfo{PID: 1, Hostname: "other", Command: commandFullBackup},
+			Expires:  time.Now().Add(-time.Minute),
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.WriteFile(filepath.Join(tmp, defaultRemoteLockName), content, 0o600)).To(Succeed())
+
+		lock, err := config.acquireRemoteLock(commandBackup)
+		Expect(err).NotTo(HaveOccurred())
+		defer lock.release()
+
+		_, err = config.acquireRemoteLock(commandBackup)
+		Expect(err).To(MatchError(ContainSubstring("on test running")))
+	})
+
+	It("should stop the command when the lock is taken over", func() {
+		config.RemoteLock.Heartbeat = 10 * time.Millisecond
+
+		lock, err := config.acquireRemoteLock(commandBackup)
+		Expect(err).NotTo(HaveOccurred())
+
+		config.activeRemoteLock = lock
+		wd := config.newWatchdog(commandBackup)
+		defer wd.stop()
+
+		Expect(os.WriteFile(filepath.Join(tmp, defaultRemoteLockName), []byte(`{"hostname":"other"}`), 0o600)).To(Succeed())
+
+		Eventually(wd.ctx.Done()).Should(BeClosed())
+		Expect(wd.err()).To(BeAssignableToTypeOf(remoteLockLostError{}))
+		Expect(exitCode(wd.err())).To(Equal(exitCodeLockLost))
+
+		// The lock of the other run is kept
+		lock.release()
+		Expect(filepath.Join(tmp, defaultRemoteLockName)).To(BeARegularFile())
+	})
+})
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Luzifer/go_helpers/v2/str"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	conflictOverwrite = "overwrite"
+	conflictRename    = "rename"
+	conflictSkip      = "skip"
+	conflictSwap      = "swap"
+
+	restoreDirPerms = 0o700
+)
+
+var conflictPolicies = []string{
+	conflictOverwrite,
+	conflictRename,
+	conflictSkip,
+	conflictSwap,
+}
+
+// restorePathsError is returned when the duplicity run of a multi path
+// restore succeeded but some of the paths could not be restored
+type restorePathsError struct {
+	failed, total int
+}
+
+func (r restorePathsError) Error() string {
+	return fmt.Sprintf("%d of %d paths could not be restored", r.failed, r.total)
+}
+
+// runRestore hands single path and full restores to duplicity and
+// orchestrates the restore of multiple paths into a common target. With
+// a conflict policy the restore is done through a staging directory.
+func runRestore(config *configFile, argv []string) error {
+	paths, target, err := restoreArguments(argv)
+	if err == nil {
+		err = config.validateConflictPolicy()
+	}
+	if err != nil {
+		logrus.WithError(err).Error("parsing restore arguments")
+		return err
+	}
+
+	switch {
+	case paths != nil:
+		return config.restoreMultiple(paths, target, cfg.RestoreTime)
+
+	case config.conflictPolicy() == "":
+		return execute(config, argv)
+
+	case len(argv) == 3: //nolint:gomnd // Command, path and target
+		return config.restoreStaged(config.relativeBackupPath(argv[1]), target, cfg.RestoreTime)
+
+	default:
+		return config.restoreStaged("", target, cfg.RestoreTime)
+	}
+}
+
+// restoreArguments collects the paths to restore from the command line
+// and the --files-from file. If a single path or no path is given
+// without a file list nil paths are returned.
+func restoreArguments(argv []string) (paths []string, target string, err error) {
+	if len(argv) < 2 { //nolint:gomnd // Command and target
+		return nil, "", errors.New("You need to specify one or more parameters: See help message")
+	}
+
+	target = argv[len(argv)-1]
+	paths = argv[1 : len(argv)-1]
+
+	if cfg.FilesFrom == "" {
+		if len(paths) < 2 { //nolint:gomnd // Single path is handled by duplicity
+			return nil, target, nil
+		}
+		return paths, target, nil
+	}
+
+	f, err := os.Open(cfg.FilesFrom)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "opening file list")
+	}
+	defer f.Close() //nolint:errcheck // File is only read
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		l := strings.TrimSpace(scanner.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		paths = append(paths, l)
+	}
+
+	if err = scanner.Err(); err != nil {
+		return nil, "", errors.Wrap(err, "reading file list")
+	}
+
+	if len(paths) == 0 {
+		return nil, "", errors.New("file list does not contain any paths")
+	}
+
+	return paths, target, nil
+}
+
+// restoreMultiple restores the given paths using a single duplicity
+// run into a staging directory and moves them into the target directory
+// keeping their path relative to the backup root
+func (c *configFile) restoreMultiple(paths []string, target, restoreTime string) error {
+	target = filepath.Clean(target)
+	if err := os.MkdirAll(target, restoreDirPerms); err != nil {
+		return errors.Wrap(err, "creating target directory")
+	}
+
+	staging, err := os.MkdirTemp(filepath.Dir(target), ".duplicity-backup-staging-")
+	if err != nil {
+		return errors.Wrap(err, "creating staging directory")
+	}
+	defer func() {
+		if err := os.RemoveAll(staging); err != nil {
+			logrus.WithError(err).Error("removing staging directory")
+		}
+	}()
+
+	restoreDir := filepath.Join(staging, "restore")
+	for i := range paths {
+		paths[i] = c.relativeBackupPath(paths[i])
+	}
+
+	logrus.Infof("++++ Restoring %d paths", len(paths))
+	if err = runDuplicity(c, append([]string{commandRestorePaths, restoreDir}, paths...), restoreTime, nil); err != nil {
+		return err
+	}
+
+	var (
+		failed int
+		suffix = time.Now().Format("20060102-150405")
+	)
+
+	for _, p := range paths {
+		src := filepath.Join(restoreDir, filepath.FromSlash(p))
+		dst := filepath.Join(target, filepath.FromSlash(p))
+
+		err := os.MkdirAll(filepath.Dir(dst), restoreDirPerms)
+		if err == nil {
+			err = mergeRestored(src, dst, c.conflictPolicy(), suffix)
+		}
+
+		if _, sErr := os.Lstat(src); os.IsNotExist(sErr) && err != nil {
+			err = errors.New("not found in backup")
+		}
+
+		if err != nil {
+			logrus.Errorf("[FAIL] %s: %s", p, err)
+			failed++
+			continue
+		}
+		logrus.Infof("[ OK ] %s", p)
+	}
+
+	logrus.Infof("++++ Restored %d of %d paths into %q", len(paths)-failed, len(paths), target)
+
+	if failed > 0 {
+		return restorePathsError{failed: failed, total: len(paths)}
+	}
+
+	return nil
+}
+
+// restoreSelection returns the file selection restoring only the given
+// paths into the restore directory
+func restoreSelection(restoreDir string, paths []string) []string {
+	var arguments []string
+	for _, p := range paths {
+		arguments = append(arguments, "--include="+path.Join(restoreDir, p))
+	}
+
+	return append(arguments, "--exclude=**")
+}
+
+// conflictPolicy returns the policy given on the command line or the
+// one configured in the config file
+func (c *configFile) conflictPolicy() string {
+	if cfg.ConflictPolicy != "" {
+		return cfg.ConflictPolicy
+	}
+
+	return c.Restore.ConflictPolicy
+}
+
+func (c *configFile) validateConflictPolicy() error {
+	if p := c.conflictPolicy(); p != "" && !str.StringInSlice(p, conflictPolicies) {
+		return errors.Errorf("unknown conflict policy %q, use one of: %s", p, strings.Join(conflictPolicies, ", "))
+	}
+
+	return nil
+}
+
+// restoreStaged restores the path (or everything if the path is empty)
+// into a staging directory next to the target and afterwards moves the
+// restored files into place according to the conflict policy
+func (c *configFile) restoreStaged(p, target, restoreTime string) error {
+	target = filepath.Clean(target)
+	if err := os.MkdirAll(filepath.Dir(target), restoreDirPerms); err != nil {
+		return errors.Wrap(err, "creating target directory")
+	}
+
+	staging, err := os.MkdirTemp(filepath.Dir(target), ".duplicity-backup-staging-")
+	if err != nil {
+		return errors.Wrap(err, "creating staging directory")
+	}
+	defer func() {
+		if err := os.RemoveAll(staging); err != nil {
+			logrus.WithError(err).Error("removing staging directory")
+		}
+	}()
+
+	argv := []string{commandRestore, filepath.Join(staging, "restore")}
+	if p != "" {
+		argv = []string{commandRestore, p, filepath.Join(staging, "restore")}
+	}
+
+	if err = runDuplicity(c, argv, restoreTime, nil); err != nil {
+		return err
+	}
+
+	return mergeRestored(
+		filepath.Join(staging, "restore"), target,
+		c.conflictPolicy(), time.Now().Format("20060102-150405"),
+	)
+}
+
+// mergeRestored moves the restored file or directory into the target.
+// Directories existing in both places are merged while conflicting
+// files are handled according to the policy. With the swap policy the
+// target is replaced as a whole and the previous version kept aside.
+func mergeRestored(src, dst, policy, suffix string) error {
+	dstInfo, err := os.Lstat(dst)
+	switch {
+	case os.IsNotExist(err):
+		return errors.Wrap(os.Rename(src, dst), "moving restored file into place")
+	case err != nil:
+		return errors.Wrap(err, "getting target file")
+	}
+
+	if policy == conflictSwap {
+		aside := dst + ".pre-restore-" + suffix
+		if err = os.Rename(dst, aside); err != nil {
+			return errors.Wrap(err, "moving existing target aside")
+		}
+
+		logrus.Infof("Moved existing %q to %q", dst, aside)
+		return errors.Wrap(os.Rename(src, dst), "moving restored file into place")
+	}
+
+	srcInfo, err := os.Lstat(src)
+	if err != nil {
+		return errors.Wrap(err, "getting restored file")
+	}
+
+	if srcInfo.IsDir() && dstInfo.IsDir() {
+		entries, err := os.ReadDir(src)
+		if err != nil {
+			return errors.Wrap(err, "reading restored directory")
+		}
+
+		for _, e := range entries {
+			if err = mergeRestored(filepath.Join(src, e.Name()), filepath.Join(dst, e.Name()), policy, suffix); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	switch policy {
+	case conflictSkip:
+		logrus.Infof("Skipped existing %q", dst)
+		return nil
+
+	case conflictOverwrite:
+		if err = os.RemoveAll(dst); err != nil {
+			return errors.Wrap(err, "removing existing file")
+		}
+		logrus.Infof("Overwrote existing %q", dst)
+		return errors.Wrap(os.Rename(src, dst), "moving restored file into place")
+
+	case "":
+		return errors.Errorf("%q already exists, use a conflict policy to restore over existing files", dst)
+
+	case conflictRename:
+		renamed := dst + ".restored-" + suffix
+		logrus.Infof("Restored %q as %q", dst, renamed)
+		return errors.Wrap(os.Rename(src, renamed), "moving restored file into place")
+
+	default:
+		return errors.Errorf("unknown conflict policy %q", policy)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+)
+
+var _ = Describe("Restore conflict handling", func() {
+	var src, dst, tmp string
+
+	writeFile := func(p, content string) {
+		Expect(os.MkdirAll(filepath.Dir(p), 0o700)).To(Succeed())
+		Expect(os.WriteFile(p, []byte(content), 0o600)).To(Succeed())
+	}
+
+	readFile := func(p string) string {
+		content, err := os.ReadFile(p)
+		Expect(err).NotTo(HaveOccurred())
+		return string(content)
+	}
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = os.MkdirTemp("", "duplicity-backup-test-")
+		Expect(err).NotTo(HaveOccurred())
+
+		src = filepath.Join(tmp, "staging")
+		dst = filepath.Join(tmp, "target")
+
+		writeFile(filepath.Join(src, "conflict.txt"), "restored")
+		writeFile(filepath.Join(src, "sub", "new.txt"), "restored")
+		writeFile(filepath.Join(dst, "conflict.txt"), "existing")
+		writeFile(filepath.Join(dst, "sub", "other.txt"), "existing")
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(tmp)).To(Succeed())
+	})
+
+	It("should keep existing files with skip policy", func() {
+		Expect(mergeRestored(src, dst, conflictSkip, "x")).To(Succeed())
+
+		Expect(readFile(filepath.Join(dst, "conflict.txt"))).To(Equal("existing"))
+		Expect(readFile(filepath.Join(dst, "sub", "new.txt"))).To(Equal("restored"))
+		Expect(readFile(filepath.Join(dst, "sub", "other.txt"))).To(Equal("existing"))
+	})
+
+	It("should replace existing files with overwrite policy", func() {
+		Expect(mergeRestored(src, dst, conflictOverwrite, "x")).To(Succeed())
+
+		Expect(readFile(filepath.Join(dst, "conflict.txt"))).To(Equal("restored"))
+		Expect(readFile(filepath.Join(dst, "sub", "other.txt"))).To(Equal("existing"))
+	})
+
+	It("should store restored files with suffix with rename policy", func() {
+		Expect(mergeRestored(src, dst, conflictRename, "x")).To(Succeed())
+
+		Expect(readFile(filepath.Join(dst, "conflict.txt"))).To(Equal("existing"))
+		Expect(readFile(filepath.Join(dst, "conflict.txt.restored-x"))).To(Equal("restored"))
+	})
+
+	It("should move the existing target aside with swap policy", func() {
+		Expect(mergeRestored(src, dst, conflictSwap, "x")).To(Succeed())
+
+		Expect(readFile(filepath.Join(dst, "conflict.txt"))).To(Equal("restored"))
+		Expect(filepath.Join(dst, "sub", "other.txt")).NotTo(BeAnExistingFile())
+		Expect(readFile(filepath.Join(dst+".pre-restore-x", "conflict.txt"))).To(Equal("existing"))
+	})
+})
+
+var _ = Describe("Restore arguments", func() {
+	var tmp string
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = os.MkdirTemp("", "duplicity-backup-test-")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		cfg.FilesFrom = ""
+		Expect(os.RemoveAll(tmp)).To(Succeed())
+	})
+
+	It("should hand single path and full restores to duplicity", func() {
+		paths, target, err := restoreArguments([]string{"restore", "data/file.txt", "/target"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(paths).To(BeNil())
+		Expect(target).To(Equal("/target"))
+
+		paths, target, err = restoreArguments([]string{"restore", "/target"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(paths).To(BeNil())
+		Expect(target).To(Equal("/target"))
+
+		_, _, err = restoreArguments([]string{"restore"})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should collect multiple paths", func() {
+		paths, target, err := restoreArguments([]string{"restore", "data/a", "data/b", "/target"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(paths).To(Equal([]string{"data/a", "data/b"}))
+		Expect(target).To(Equal("/target"))
+	})
+
+	It("should read paths from the file list", func() {
+		cfg.FilesFrom = filepath.Join(tmp, "files")
+		Expect(os.WriteFile(cfg.FilesFrom, []byte("# comment\ndata/b\n\n  data/c  \n"), 0o600)).To(Succeed())
+
+		paths, _, err := restoreArguments([]string{"restore", "data/a", "/target"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(paths).To(Equal([]string{"data/a", "data/b", "data/c"}))
+
+		Expect(os.WriteFile(cfg.FilesFrom, []byte("# only a comment\n"), 0o600)).To(Succeed())
+		_, _, err = restoreArguments([]string{"restore", "/target"})
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("Multi path restore", func() {
+	var (
+		config  *configFile
+		tmp     string
+		origBin = duplicityBinary
+		fakeRun = func(script string) {
+			duplicityBinary = filepath.Join(tmp, "duplicity")
+			Expect(os.WriteFile(duplicityBinary, []byte("#!/bin/sh\n"+script), 0o700)).To(Succeed()) //#nosec:G306 // Fake binary needs to be executable
+		}
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = os.MkdirTemp("", "duplicity-backup-test-")
+		Expect(err).NotTo(HaveOccurred())
+
+		config, err = loadConfigFile(strings.NewReader("root: " + tmp + "\ndest: file://" + tmp + "/dest\nlogdir: " + tmp + "\n"))
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		duplicityBinary = origBin
+		Expect(os.RemoveAll(tmp)).To(Succeed())
+	})
+
+	It("should return the failure of the duplicity run", func() {
+		fakeRun("echo 'Error: 403 Forbidden'\nexit 23\n")
+
+		err := config.restoreMultiple([]string{"data/a", "data/b"}, filepath.Join(tmp, "target"), "")
+		Expect(errors.As(err, new(restorePathsError))).To(BeFalse())
+		Expect(err.Error()).To(ContainSubstring("403 Forbidden"))
+		Expect(exitCode(err)).To(Equal(23))
+	})
+
+	It("should report paths missing in the backup", func() {
+		fakeRun("exit 0\n")
+
+		err := config.restoreMultiple([]string{"data/a", "data/b"}, filepath.Join(tmp, "target"), "")
+		Expect(err).To(Equal(restorePathsError{failed: 2, total: 2}))
+	})
+})
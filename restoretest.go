@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const defaultRestoreTestSampleSize = 5
+
+// runRestoreTest restores a sample of files from the latest backup into
+// a temporary directory and verifies them against the backup metadata
+func runRestoreTest(config *configFile) error {
+	err := config.restoreTest()
+	if err != nil {
+		logrus.WithError(err).Error("Restore test failed")
+
+		notifyFailure(config, commandRestoreTest, err)
+	}
+
+	return err
+}
+
+func (c *configFile) restoreTest() error {
+	files, err := c.listFiles("")
+	if err != nil {
+		return errors.Wrap(err, "fetching file list")
+	}
+
+	candidates, err := c.restoreTestCandidates(files)
+	if err != nil {
+		return errors.Wrap(err, "selecting files to restore")
+	}
+
+	if len(candidates) == 0 {
+		return errors.New("backup does not contain any files to restore")
+	}
+
+	tmpDir, err := os.MkdirTemp(c.RestoreTest.TempDir, "duplicity-backup-restore-test-")
+	if err != nil {
+		return errors.Wrap(err, "creating temporary directory")
+	}
+	defer func() {
+		if err := os.RemoveAll(tmpDir); err != nil {
+			logrus.WithError(err).Error("removing temporary directory")
+		}
+	}()
+
+	paths := make([]string, len(candidates))
+	for i, f := range candidates {
+		paths[i] = f.Path
+	}
+
+	// Single files failing to restore are reported by the verification,
+	// failures of the restore itself carry the diagnosed cause
+	if err = c.restoreMultiple(paths, tmpDir, ""); err != nil {
+		if !errors.As(err, new(restorePathsError)) {
+			return errors.Wrap(err, "restoring files")
+		}
+		logrus.WithError(err).Error("restoring files")
+	}
+
+	var failed []string
+	for _, f := range candidates {
+		if err = c.verifyRestoredFile(f, filepath.Join(tmpDir, filepath.FromSlash(f.Path))); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", f.Path, err))
+			continue
+		}
+
+		logrus.Infof("Restored %q successfully", f.Path)
+	}
+
+	if len(failed) > 0 {
+		return errors.Errorf("%d of %d files failed:\n- %s", len(failed), len(candidates), strings.Join(failed, "\n- "))
+	}
+
+	return nil
+}
+
+// restoreTestCandidates selects the configured canary paths or a random
+// sample of the files in the backup
+func (c *configFile) restoreTestCandidates(files []backupFile) ([]backupFile, error) {
+	if len(c.RestoreTest.CanaryPaths) > 0 {
+		known := map[string]backupFile{}
+		for _, f := range files {
+			known[f.Path] = f
+		}
+
+		var candidates []backupFile
+		for _, p := range c.RestoreTest.CanaryPaths {
+			f, ok := known[c.relativeBackupPath(p)]
+			if !ok {
+				return nil, errors.Errorf("canary path %q is not contained in the backup", p)
+			}
+			candidates = append(candidates, f)
+		}
+
+		return candidates, nil
+	}
+
+	sampleSize := c.RestoreTest.SampleSize
+	if sampleSize <= 0 {
+		sampleSize = defaultRestoreTestSampleSize
+	}
+
+	candidates := leafFiles(files)
+	rand.Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] }) // #nosec G404 // No need for crypto here
+	if len(candidates) > sampleSize {
+		candidates = candidates[:sampleSize]
+	}
+
+	return candidates, nil
+}
+
+// relativeBackupPath converts paths given absolute or relative to the
+// root into the form duplicity uses in its listings
+func (c *configFile) relativeBackupPath(p string) string {
+	if filepath.IsAbs(p) {
+		if rel, err := filepath.Rel(c.RootPath, p); err == nil {
+			p = rel
+		}
+	}
+
+	return filepath.ToSlash(filepath.Clean(p))
+}
+
+// verifyRestoredFile checks the restored file against the modification
+// time stored in the backup. If the live file is unchanged since the
+// backup its size and content are compared as well.
+func (c *configFile) verifyRestoredFile(f backupFile, target string) error {
+	restored, err := os.Lstat(target)
+	if err != nil {
+		return errors.Wrap(err, "getting restored file")
+	}
+
+	if restored.ModTime().Unix() != f.ModTime.Unix() {
+		return errors.Errorf("modification time %s does not match backup metadata %s", restored.ModTime(), f.ModTime)
+	}
+
+	if !restored.Mode().IsRegular() {
+		return nil
+	}
+
+	livePath := filepath.Join(c.RootPath, filepath.FromSlash(f.Path))
+	live, err := os.Lstat(livePath)
+	if err != nil || !live.Mode().IsRegular() || live.ModTime().Unix() != f.ModTime.Unix() {
+		logrus.Debugf("Live file %q changed since backup, skipping content check", livePath)
+		return nil
+	}
+
+	if live.Size() != restored.Size() {
+		return errors.Errorf("size %d does not match size %d of unchanged live file", restored.Size(), live.Size())
+	}
+
+	restoredHash, err := hashFile(target)
+	if err != nil {
+		return errors.Wrap(err, "hashing restored file")
+	}
+
+	liveHash, err := hashFile(livePath)
+	if err != nil {
+		return errors.Wrap(err, "hashing live file")
+	}
+
+	if restoredHash != liveHash {
+		return errors.New("content does not match unchanged live file")
+	}
+
+	return nil
+}
+
+func hashFile(filePath string) (string, error) {
+	f, err := os.Open(filePath) //#nosec:G304 // Intended to read arbitrary files
+	if err != nil {
+		return "", errors.Wrap(err, "opening file")
+	}
+	defer f.Close() //nolint:errcheck // File is only read
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", errors.Wrap(err, "reading file")
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
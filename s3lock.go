@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Luzifer/go_helpers/v2/str"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultS3Endpoint = "https://s3.amazonaws.com"
+	defaultS3Region   = "us-east-1"
+
+	s3RequestTimeout = 30 * time.Second
+	s3TimeFormat     = "20060102T150405Z"
+	s3DateFormat     = "20060102"
+)
+
+// s3LockBackend stores the lock as an object and uses conditional
+// requests (If-None-Match / If-Match) to detect concurrent changes
+type s3LockBackend struct {
+	endpoint     *url.URL
+	region       string
+	bucket       string
+	key          string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+// s3LockBackend builds the backend from the destination. Destinations
+// in the form s3://host/bucket/prefix carry their endpoint unless one
+// is configured while for s3+http://bucket/prefix the configured or
+// default endpoint is used.
+func (c *configFile) s3LockBackend(dest *url.URL, name string) (remoteLockBackend, error) {
+	b := s3LockBackend{
+		region:       c.RemoteLock.S3Region,
+		bucket:       dest.Host,
+		key:          path.Join(strings.TrimPrefix(dest.Path, "/"), name),
+		accessKey:    c.AWS.AccessKeyID,
+		secretKey:    c.AWS.SecretAccessKey,
+		sessionToken: c.AWS.SessionToken,
+	}
+
+	endpoint := c.RemoteLock.S3Endpoint
+	if endpoint == "" {
+		endpoint = defaultS3Endpoint
+	}
+
+	if dest.Scheme == "s3" {
+		var prefix string
+		b.bucket, prefix, _ = strings.Cut(strings.TrimPrefix(dest.Path, "/"), "/")
+		b.key = path.Join(prefix, name)
+
+		if c.RemoteLock.S3Endpoint == "" {
+			// Same as duplicity: encrypted unless disabled explicitly
+			scheme := "https"
+			if str.StringInSlice("--s3-unencrypted-connection", c.StaticBackupOptions) {
+				scheme = "http"
+			}
+			endpoint = scheme + "://" + dest.Host
+		}
+	}
+
+	if b.region == "" {
+		b.region = defaultS3Region
+	}
+
+	if b.accessKey == "" {
+		b.accessKey, b.secretKey = os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+		b.sessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+
+	var err error
+	if b.endpoint, err = url.Parse(endpoint); err != nil {
+		return nil, errors.Wrap(err, "parsing s3 endpoint")
+	}
+
+	if b.bucket == "" {
+		return nil, errors.Errorf("no bucket found in destination %q", dest.Redacted())
+	}
+
+	return b, nil
+}
+
+func (s s3LockBackend) create(content []byte) (string, error) {
+	return s.put(content, map[string]string{"If-None-Match": "*"})
+}
+
+func (s s3LockBackend) read() ([]byte, string, error) {
+	res, err := s.do(http.MethodGet, nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close() //nolint:errcheck // Body is only read
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		content, err := io.ReadAll(res.Body)
+		return content, res.Header.Get("ETag"), errors.Wrap(err, "reading lock object")
+
+	case http.StatusNotFound:
+		return nil, "", errors.Wrap(os.ErrNotExist, "reading lock object")
+
+	default:
+		return nil, "", s.statusError(res)
+	}
+}
+
+func (s s3LockBackend) replace(content []byte, version string) (string, error) {
+	return s.put(content, map[string]string{"If-Match": version})
+}
+
+func (s s3LockBackend) remove(version string) error {
+	_, current, err := s.read()
+	if err != nil {
+		return err
+	}
+
+	if current != version {
+		return errRemoteLockConflict
+	}
+
+	res, err := s.do(http.MethodDelete, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close() //nolint:errcheck // Body is not used
+
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK {
+		return s.statusError(res)
+	}
+
+	return nil
+}
+
+func (s s3LockBackend) put(content []byte, headers map[string]string) (string, error) {
+	res, err := s.do(http.MethodPut, content, headers)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close() //nolint:errcheck // Body is not used
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		return res.Header.Get("ETag"), nil
+
+	case http.StatusPreconditionFailed, http.StatusConflict:
+		return "", errRemoteLockConflict
+
+	default:
+		return "", s.statusError(res)
+	}
+}
+
+// do executes a request against the lock object signed using AWS
+// signature version 4
+func (s s3LockBackend) do(method string, body []byte, headers map[string]string) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s3RequestTimeout)
+	defer cancel()
+
+	u := *s.endpoint
+	u.Path = path.Join("/", s.bucket, s.key)
+	u.RawPath = s3EscapePath(u.Path)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "creating request")
+	}
+
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	s.sign(req, body, time.Now().UTC())
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "executing request")
+	}
+
+	// Read the body before the context is cancelled
+	content, err := io.ReadAll(res.Body)
+	res.Body.Close() //nolint:errcheck,gosec // Body is fully read
+	if err != nil {
+		return nil, errors.Wrap(err, "reading response")
+	}
+	res.Body = io.NopCloser(bytes.NewReader(content))
+
+	return res, nil
+}
+
+func (s s3LockBackend) sign(req *http.Request, body []byte, now time.Time) {
+	var (
+		payloadHash = fmt.Sprintf("%x", sha256.Sum256(body))
+		amzDate     = now.Format(s3TimeFormat)
+		scope       = strings.Join([]string{now.Format(s3DateFormat), s.region, "s3", "aws4_request"}, "/")
+	)
+
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	req.Header.Set("X-Amz-Date", amzDate)
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	// All headers set on the request are signed
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, n := range names {
+		canonicalHeaders.WriteString(n + ":" + headers[n] + "\n")
+	}
+
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		fmt.Sprintf("%x", sha256.Sum256([]byte(canonicalRequest))),
+	}, "\n")
+
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range strings.Split(scope, "/") {
+		key = hmacSHA256(key, part)
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%x",
+		s.accessKey, scope, signedHeaders, hmacSHA256(key, stringToSign),
+	))
+}
+
+func (s s3LockBackend) statusError(res *http.Response) error {
+	body, _ := io.ReadAll(res.Body) //#nosec:G104 // Body is only used for the error message
+	return errors.Errorf("unexpected status code %d for lock object %s/%s: %s",
+		res.StatusCode, s.bucket, s.key, strings.TrimSpace(string(body)))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data)) //nolint:errcheck,gosec // Writing to hash never fails
+	return h.Sum(nil)
+}
+
+// s3EscapePath escapes the path according to the rules of the AWS
+// signature: everything except unreserved characters and slashes is
+// percent-encoded
+func s3EscapePath(p string) string {
+	var sb strings.Builder
+
+	for _, b := range []byte(p) {
+		switch {
+		case b >= 'A' && b <= 'Z', b >= 'a' && b <= 'z', b >= '0' && b <= '9',
+			b == '-', b == '.', b == '_', b == '~', b == '/':
+			sb.WriteByte(b)
+		default:
+			fmt.Fprintf(&sb, "%%%02X", b)
+		}
+	}
+
+	return sb.String()
+}
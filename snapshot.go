@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	snapshotTypeBtrfs = "btrfs"
+	snapshotTypeLVM   = "lvm"
+	snapshotTypeZFS   = "zfs"
+
+	snapshotName           = "duplicity-backup"
+	snapshotCommandTimeout = 10 * time.Minute
+	snapshotMountPerms     = 0o700
+)
+
+type (
+	snapshotConfig struct {
+		Type         string   `yaml:"type"`
+		Source       string   `yaml:"source"`
+		Path         string   `yaml:"path"`
+		Mountpoint   string   `yaml:"mountpoint"`
+		Size         string   `yaml:"size"`
+		MountOptions []string `yaml:"mount_options"`
+	}
+
+	// snapshot represents a created snapshot mounted into the mountpoint
+	snapshot struct {
+		config   snapshotConfig
+		livePath string
+		filelist string
+		mounted  bool
+		created  bool
+	}
+)
+
+func (s snapshotConfig) validate() error {
+	switch s.Type {
+	case "":
+		return nil
+
+	case snapshotTypeBtrfs, snapshotTypeZFS:
+
+	case snapshotTypeLVM:
+		if s.Size == "" {
+			return errors.New("lvm snapshot requires a size")
+		}
+
+	default:
+		return errors.Errorf("unknown snapshot type %q", s.Type)
+	}
+
+	if s.Source == "" || s.Mountpoint == "" {
+		return errors.New("snapshot requires source and mountpoint")
+	}
+
+	return nil
+}
+
+// createSnapshot creates and mounts the configured snapshot and makes
+// the backup commands read from the snapshot instead of the live data.
+// removeSnapshot must be called after the backup regardless of errors.
+func (c *configFile) createSnapshot() error {
+	if c.Snapshot.Type == "" || cfg.DryRun {
+		return nil
+	}
+
+	s := &snapshot{
+		config:   c.Snapshot,
+		livePath: c.Snapshot.Path,
+	}
+
+	if s.livePath == "" {
+		s.livePath = c.RootPath
+	}
+
+	logrus.Infof("++++ Creating %s snapshot of %q", s.config.Type, s.config.Source)
+
+	c.activeSnapshot = s
+	if err := s.create(); err != nil {
+		return err
+	}
+
+	return errors.Wrap(c.rewriteIncExcFile(), "rewriting include / exclude file")
+}
+
+// removeSnapshot tears down the active snapshot if there is one
+func (c *configFile) removeSnapshot() {
+	if c.activeSnapshot == nil {
+		return
+	}
+
+	c.activeSnapshot.teardown()
+	c.activeSnapshot = nil
+}
+
+func (s *snapshot) create() error {
+	if err := s.removeStale(); err != nil {
+		return err
+	}
+
+	switch s.config.Type {
+	case snapshotTypeBtrfs:
+		// The snapshot is created inside the mountpoint as btrfs would
+		// do so anyway for an existing directory
+		if err := os.MkdirAll(s.config.Mountpoint, snapshotMountPerms); err != nil {
+			return errors.Wrap(err, "creating mountpoint")
+		}
+
+		if err := s.run("btrfs", "subvolume", "snapshot", "-r", s.config.Source, s.snapshotPath()); err != nil {
+			return errors.Wrap(err, "creating btrfs snapshot")
+		}
+		s.created = true
+		return nil
+
+	case snapshotTypeLVM:
+		if err := s.run("lvcreate", "--snapshot", "--size", s.config.Size, "--name", s.lvmName(), s.config.Source); err != nil {
+			return errors.Wrap(err, "creating lvm snapshot")
+		}
+
+	case snapshotTypeZFS:
+		if err := s.run("zfs", "snapshot", s.snapshotPath()); err != nil {
+			return errors.Wrap(err, "creating zfs snapshot")
+		}
+	}
+
+	s.created = true
+
+	if err := os.MkdirAll(s.config.Mountpoint, snapshotMountPerms); err != nil {
+		return errors.Wrap(err, "creating mountpoint")
+	}
+
+	mountCmd := []string{"mount", "-o", strings.Join(append([]string{"ro"}, s.config.MountOptions...), ",")}
+	if s.config.Type == snapshotTypeZFS {
+		mountCmd = append(mountCmd, "-t", "zfs")
+	}
+
+	if err := s.run(append(mountCmd, s.snapshotPath(), s.config.Mountpoint)...); err != nil {
+		return errors.Wrap(err, "mounting snapshot")
+	}
+	s.mounted = true
+
+	return nil
+}
+
+// removeStale removes the snapshot left behind by a previous run which
+// was killed before tearing it down. As the snapshot is only used while
+// holding the lock it is not in use by another run.
+func (s *snapshot) removeStale() error {
+	if !s.exists() {
+		return nil
+	}
+
+	stale := &snapshot{
+		config:  s.config,
+		mounted: s.config.Type != snapshotTypeBtrfs && isMounted(s.config.Mountpoint),
+		created: true,
+	}
+
+	logrus.Warnf("Removing stale %s snapshot %q left by a previous run", s.config.Type, s.snapshotPath())
+	stale.teardown()
+
+	if stale.mounted || stale.created {
+		return errors.Errorf("stale snapshot %q could not be removed", s.snapshotPath())
+	}
+
+	return nil
+}
+
+// exists checks whether the snapshot is present
+func (s *snapshot) exists() bool {
+	if s.config.Type == snapshotTypeZFS {
+		return exec.Command("zfs", "list", "-H", "-t", "snapshot", s.snapshotPath()).Run() == nil // #nosec G204 // Intended to run zfs
+	}
+
+	// Subvolume of btrfs or device of lvm
+	_, err := os.Stat(s.snapshotPath())
+	return err == nil
+}
+
+// teardown unmounts and removes the snapshot. Errors are logged as the
+// teardown is executed regardless of the result of the backup.
+func (s *snapshot) teardown() {
+	if s.filelist != "" {
+		if err := os.Remove(s.filelist); err != nil {
+			logrus.WithError(err).Error("removing rewritten include / exclude file")
+		}
+		s.filelist = ""
+	}
+
+	if s.mounted {
+		if err := s.run("umount", s.config.Mountpoint); err != nil {
+			logrus.WithError(err).Error("unmounting snapshot")
+			return
+		}
+		s.mounted = false
+	}
+
+	if !s.created {
+		return
+	}
+
+	logrus.Infof("++++ Removing %s snapshot of %q", s.config.Type, s.config.Source)
+
+	var err error
+	switch s.config.Type {
+	case snapshotTypeBtrfs:
+		err = s.run("btrfs", "subvolume", "delete", s.snapshotPath())
+	case snapshotTypeLVM:
+		err = s.run("lvremove", "--force", s.snapshotPath())
+	case snapshotTypeZFS:
+		err = s.run("zfs", "destroy", s.snapshotPath())
+	}
+
+	if err != nil {
+		logrus.WithError(err).Error("removing snapshot")
+		return
+	}
+	s.created = false
+}
+
+func (s *snapshot) lvmName() string {
+	return filepath.Base(s.config.Source) + "-" + snapshotName
+}
+
+// snapshotPath returns the identifier of the snapshot: the path of the
+// btrfs subvolume, the device of the lvm snapshot or the zfs snapshot
+func (s *snapshot) snapshotPath() string {
+	switch s.config.Type {
+	case snapshotTypeLVM:
+		return filepath.Join(filepath.Dir(s.config.Source), s.lvmName())
+	case snapshotTypeZFS:
+		return s.config.Source + "@" + snapshotName
+	default:
+		return filepath.Join(s.config.Mountpoint, snapshotName)
+	}
+}
+
+// dataPath returns the path the data of the snapshot is accessible at
+func (s *snapshot) dataPath() string {
+	if s.config.Type == snapshotTypeBtrfs {
+		return s.snapshotPath()
+	}
+
+	return s.config.Mountpoint
+}
+
+// isMounted checks whether a filesystem is mounted at the path
+func isMounted(p string) bool {
+	mounts, err := os.ReadFile("/proc/self/mounts")
+	if err != nil {
+		return false
+	}
+
+	for _, l := range strings.Split(string(mounts), "\n") {
+		fields := strings.Fields(l)
+		if len(fields) > 1 && strings.ReplaceAll(fields[1], `\040`, " ") == filepath.Clean(p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (*snapshot) run(command ...string) error {
+	// Not bound to interrupts as the snapshot has to be removed anyway
+	return runLoggedCommand(context.Background(), command, nil, snapshotCommandTimeout, logrus.WithField("snapshot", command[0]))
+}
+
+// snapshotPath translates a path of the live data into the path inside
+// the mounted snapshot if a snapshot is active
+func (c *configFile) snapshotPath(p string) string {
+	if c.activeSnapshot == nil {
+		return p
+	}
+
+	rel, err := filepath.Rel(c.activeSnapshot.livePath, p)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return p
+	}
+
+	return filepath.Join(c.activeSnapshot.dataPath(), rel)
+}
+
+// rewriteIncExcFile writes a copy of the include / exclude file with
+// the paths translated into the snapshot as duplicity rejects paths
+// outside the source
+func (c *configFile) rewriteIncExcFile() error {
+	if c.IncExcFile == "" || c.activeSnapshot == nil {
+		return nil
+	}
+
+	content, err := os.ReadFile(c.IncExcFile)
+	if err != nil {
+		return errors.Wrap(err, "reading file")
+	}
+
+	lines := strings.Split(string(content), "\n")
+	for i, l := range lines {
+		lines[i] = c.snapshotFilelistLine(l)
+	}
+
+	f, err := os.CreateTemp("", "duplicity-backup-filelist-")
+	if err != nil {
+		return errors.Wrap(err, "creating file")
+	}
+	defer f.Close() //nolint:errcheck // Close errors are checked below
+
+	c.activeSnapshot.filelist = f.Name()
+	if _, err = f.WriteString(strings.Join(lines, "\n")); err != nil {
+		return errors.Wrap(err, "writing file")
+	}
+
+	return errors.Wrap(f.Close(), "closing file")
+}
+
+// snapshotFilelistLine translates the absolute path in a line of a
+// globbing filelist into the snapshot keeping the +/- prefix
+func (c *configFile) snapshotFilelistLine(l string) string {
+	var prefix string
+	if strings.HasPrefix(l, "+ ") || strings.HasPrefix(l, "- ") {
+		prefix, l = l[:2], l[2:]
+	}
+
+	if !strings.HasPrefix(l, "/") {
+		return prefix + l
+	}
+
+	p := c.snapshotPath(l)
+	if strings.HasSuffix(l, "/") && !strings.HasSuffix(p, "/") {
+		// Trailing slash restricts the match to directories
+		p += "/"
+	}
+
+	return prefix + p
+}
+
+// incExcFile returns the include / exclude file to use which is the
+// rewritten one while a snapshot is active
+func (c *configFile) incExcFile() string {
+	if c.activeSnapshot != nil && c.activeSnapshot.filelist != "" {
+		return c.activeSnapshot.filelist
+	}
+
+	return c.IncExcFile
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	sourceTypeMySQL    = "mysql"
+	sourceTypePostgres = "postgres"
+	sourceTypeSQLite   = "sqlite"
+
+	defaultDumpDirRelPath = ".duplicity-backup-dumps"
+	defaultDumpTimeout    = time.Hour
+	dumpDirPerms          = 0o700
+)
+
+type (
+	sourceConfig struct {
+		Name     string        `yaml:"name"`
+		Type     string        `yaml:"type"`
+		Database string        `yaml:"database"`
+		Host     string        `yaml:"host"`
+		Port     int           `yaml:"port"`
+		User     string        `yaml:"user"`
+		Password string        `yaml:"password"`
+		Path     string        `yaml:"path"`
+		Options  []string      `yaml:"options"`
+		Timeout  time.Duration `yaml:"timeout"`
+	}
+
+	dumpResult struct {
+		Name     string
+		Size     int64
+		Duration time.Duration
+	}
+)
+
+func (s sourceConfig) validate() error {
+	if s.Name == "" {
+		return errors.New("source has no name")
+	}
+
+	switch s.Type {
+	case sourceTypeMySQL, sourceTypePostgres:
+		if s.Database == "" {
+			return errors.Errorf("source %q has no database", s.Name)
+		}
+
+	case sourceTypeSQLite:
+		if s.Path == "" {
+			return errors.Errorf("source %q has no path", s.Name)
+		}
+
+	default:
+		return errors.Errorf("source %q has unknown type %q", s.Name, s.Type)
+	}
+
+	return nil
+}
+
+// command assembles the dump command writing into the target file and
+// the environment variables to pass the password
+func (s sourceConfig) command(target string) ([]string, map[string]string) {
+	var (
+		cmd []string
+		env = map[string]string{}
+	)
+
+	switch s.Type {
+	case sourceTypeMySQL:
+		cmd = []string{"mysqldump", "--single-transaction", "--result-file=" + target}
+		cmd = appendIfSet(cmd, "--host=", s.Host)
+		cmd = appendIfSet(cmd, "--user=", s.User)
+		if s.Port > 0 {
+			cmd = append(cmd, "--port="+strconv.Itoa(s.Port))
+		}
+		env["MYSQL_PWD"] = s.Password
+
+	case sourceTypePostgres:
+		cmd = []string{"pg_dump", "--format=custom", "--file=" + target}
+		cmd = appendIfSet(cmd, "--host=", s.Host)
+		cmd = appendIfSet(cmd, "--username=", s.User)
+		if s.Port > 0 {
+			cmd = append(cmd, "--port="+strconv.Itoa(s.Port))
+		}
+		env["PGPASSWORD"] = s.Password
+
+	case sourceTypeSQLite:
+		// The .backup command uses the online backup API of SQLite
+		return append([]string{"sqlite3"}, append(s.Options, s.Path, fmt.Sprintf(".backup '%s'", target))...), env
+	}
+
+	cmd = append(cmd, s.Options...)
+	return append(cmd, s.Database), env
+}
+
+func (s sourceConfig) fileName() string {
+	switch s.Type {
+	case sourceTypeMySQL:
+		return s.Name + ".sql"
+	case sourceTypePostgres:
+		return s.Name + ".pgdump"
+	default:
+		return s.Name + ".sqlite"
+	}
+}
+
+func appendIfSet(cmd []string, flag, value string) []string {
+	if value == "" {
+		return cmd
+	}
+	return append(cmd, flag+value)
+}
+
+// dumpDir returns the path of the directory the sources are dumped to
+// relative to the root in the form duplicity uses in its listings
+func (c *configFile) dumpDir() string {
+	if c.DumpDirectory == "" {
+		return defaultDumpDirRelPath
+	}
+
+	return c.relativeBackupPath(c.DumpDirectory)
+}
+
+// dumpSources dumps all configured database sources into the dump
+// directory inside the root to be picked up by the backup
+func (c *configFile) dumpSources() ([]dumpResult, error) {
+	if len(c.Sources) == 0 || cfg.DryRun {
+		return nil, nil
+	}
+
+	logrus.Info("++++ Dumping sources")
+
+	dir := filepath.Join(c.RootPath, filepath.FromSlash(c.dumpDir()))
+	if err := os.MkdirAll(dir, dumpDirPerms); err != nil {
+		return nil, errors.Wrap(err, "creating dump directory")
+	}
+
+	var results []dumpResult
+	for _, s := range c.Sources {
+		var (
+			start    = time.Now()
+			target   = filepath.Join(dir, s.fileName())
+			cmd, env = s.command(target)
+			timeout  = s.Timeout
+		)
+
+		if timeout <= 0 {
+			timeout = defaultDumpTimeout
+		}
+
+		if err := runLoggedCommand(interruptCtx, cmd, []map[string]string{env}, timeout, logrus.WithField("source", s.Name)); err != nil {
+			return results, exitCodeError{code: exitCodeDump, err: errors.Wrapf(err, "dumping source %q", s.Name)}
+		}
+
+		info, err := os.Stat(target)
+		if err != nil {
+			return results, errors.Wrapf(err, "getting dump of source %q", s.Name)
+		}
+
+		result := dumpResult{Name: s.Name, Size: info.Size(), Duration: time.Since(start)}
+		logrus.Info(result)
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// cleanupDumps removes the dump directory after the backup
+func (c *configFile) cleanupDumps() {
+	if len(c.Sources) == 0 || cfg.DryRun {
+		return
+	}
+
+	if err := os.RemoveAll(filepath.Join(c.RootPath, filepath.FromSlash(c.dumpDir()))); err != nil {
+		logrus.WithError(err).Error("removing dump directory")
+	}
+}
+
+func (d dumpResult) String() string {
+	return fmt.Sprintf("Dumped source %s (%s in %s)", d.Name, formatBytes(d.Size), d.Duration.Round(time.Second))
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	throttleTimeFormat = "15:04"
+
+	maxIONiceLevel = 7
+	minNice        = -20
+	maxNice        = 19
+)
+
+var (
+	// ioniceClasses maps the class names to the classes of ionice(1)
+	ioniceClasses = map[string]string{
+		"realtime":    "1",
+		"best-effort": "2",
+		"idle":        "3",
+	}
+
+	rateRE = regexp.MustCompile(`(?i)^([\d.]+)\s*([KMG])B?(?:/s)?$`)
+)
+
+type (
+	throttleConfig struct {
+		Bandwidth []bandwidthWindow `yaml:"bandwidth"`
+		Nice      int               `yaml:"nice"`
+		IONice    struct {
+			Class string `yaml:"class"`
+			Level *int   `yaml:"level"`
+		} `yaml:"ionice"`
+	}
+
+	// bandwidthWindow limits the upload rate between From and To, windows
+	// with To before From span midnight
+	bandwidthWindow struct {
+		From   string `yaml:"from"`
+		To     string `yaml:"to"`
+		Upload string `yaml:"upload"`
+	}
+)
+
+func (t throttleConfig) validate() error {
+	for _, w := range t.Bandwidth {
+		if _, err := w.contains(time.Now()); err != nil {
+			return err
+		}
+
+		if _, err := parseRate(w.Upload); err != nil {
+			return err
+		}
+	}
+
+	if t.Nice < minNice || t.Nice > maxNice {
+		return errors.Errorf("nice must be between %d and %d", minNice, maxNice)
+	}
+
+	if t.IONice.Class == "" {
+		return nil
+	}
+
+	if runtime.GOOS != "linux" {
+		return errors.New("ionice is only supported on linux")
+	}
+
+	if _, ok := ioniceClasses[t.IONice.Class]; !ok {
+		return errors.Errorf("unknown ionice class %q, use realtime, best-effort or idle", t.IONice.Class)
+	}
+
+	if l := t.IONice.Level; l != nil && (*l < 0 || *l > maxIONiceLevel) {
+		return errors.Errorf("ionice level must be between 0 and %d", maxIONiceLevel)
+	}
+
+	return nil
+}
+
+// requiredCommands lists the commands needed to apply the configured
+// limits and priorities
+func (t throttleConfig) requiredCommands() []string {
+	var commands []string
+
+	if len(t.Bandwidth) > 0 {
+		commands = append(commands, "trickle")
+	}
+
+	if t.IONice.Class != "" {
+		commands = append(commands, "ionice")
+	}
+
+	if t.Nice != 0 {
+		commands = append(commands, "nice")
+	}
+
+	return commands
+}
+
+// checkCommands ensures the required commands are available to report
+// them by name instead of failing to start duplicity
+func (t throttleConfig) checkCommands() error {
+	for _, c := range t.requiredCommands() {
+		if _, err := exec.LookPath(c); err != nil {
+			return errors.Wrapf(err, "finding %s", c)
+		}
+	}
+
+	return nil
+}
+
+// uploadLimit returns the lowest upload limit in KB/s of the windows
+// the run started at the given time reaches within its maximum runtime
+// or 0 for unlimited uploads. As trickle cannot change the limit of a
+// running process runs without maximum runtime are limited by all
+// windows.
+func (t throttleConfig) uploadLimit(now time.Time, maxRuntime time.Duration) int {
+	var limit int
+
+	for _, w := range t.Bandwidth {
+		if !w.reached(now, maxRuntime) {
+			continue
+		}
+
+		rate, _ := parseRate(w.Upload) // #nosec G104 // Rates are validated on load
+		if limit == 0 || rate < limit {
+			limit = rate
+		}
+	}
+
+	return limit
+}
+
+// wrapCommand ensures the required commands are available and wraps the
+// command using buildCommand
+func (t throttleConfig) wrapCommand(now time.Time, maxRuntime time.Duration, name string, args ...string) (string, []string, error) {
+	if err := t.checkCommands(); err != nil {
+		return "", nil, errors.Wrap(err, "checking throttle commands")
+	}
+
+	name, args = t.buildCommand(now, maxRuntime, name, args...)
+	return name, args, nil
+}
+
+// buildCommand prefixes the command with trickle, ionice and nice as
+// configured. All of them exec the wrapped command so signals are still
+// delivered to duplicity.
+func (t throttleConfig) buildCommand(now time.Time, maxRuntime time.Duration, name string, args ...string) (string, []string) {
+	command := append([]string{name}, args...)
+
+	if rate := t.uploadLimit(now, maxRuntime); rate > 0 {
+		if maxRuntime <= 0 {
+			logrus.Infof("Limiting upload rate to %d KB/s, the lowest limit of the bandwidth windows as no timeout is configured", rate)
+		} else {
+			logrus.Infof("Limiting upload rate to %d KB/s until the run ends", rate)
+		}
+		command = append([]string{"trickle", "-s", "-u", strconv.Itoa(rate)}, command...)
+	}
+
+	if t.IONice.Class != "" {
+		ionice := []string{"ionice", "-c", ioniceClasses[t.IONice.Class]}
+		if t.IONice.Level != nil {
+			ionice = append(ionice, "-n", strconv.Itoa(*t.IONice.Level))
+		}
+		command = append(ionice, command...)
+	}
+
+	if t.Nice != 0 {
+		command = append([]string{"nice", "-n", strconv.Itoa(t.Nice)}, command...)
+	}
+
+	return command[0], command[1:]
+}
+
+// reached reports whether a run started at the given time is within the
+// window at its start or the window starts before the maximum runtime is
+// exceeded. Without maximum runtime every window is reached.
+func (w bandwidthWindow) reached(now time.Time, maxRuntime time.Duration) bool {
+	if maxRuntime <= 0 {
+		return true
+	}
+
+	if ok, _ := w.contains(now); ok { // #nosec G104 // Windows are validated on load
+		return true
+	}
+
+	from, err := time.Parse(throttleTimeFormat, w.From)
+	if err != nil {
+		return false
+	}
+
+	start := time.Date(now.Year(), now.Month(), now.Day(), from.Hour(), from.Minute(), 0, 0, now.Location())
+	if !start.After(now) {
+		start = start.AddDate(0, 0, 1)
+	}
+
+	return start.Before(now.Add(maxRuntime))
+}
+
+func (w bandwidthWindow) contains(now time.Time) (bool, error) {
+	from, err := time.Parse(throttleTimeFormat, w.From)
+	if err != nil {
+		return false, errors.Wrapf(err, "parsing bandwidth window start %q", w.From)
+	}
+
+	to, err := time.Parse(throttleTimeFormat, w.To)
+	if err != nil {
+		return false, errors.Wrapf(err, "parsing bandwidth window end %q", w.To)
+	}
+
+	var (
+		start   = from.Hour()*60 + from.Minute() //nolint:gomnd // Minutes of the day
+		end     = to.Hour()*60 + to.Minute()     //nolint:gomnd // Minutes of the day
+		current = now.Hour()*60 + now.Minute()   //nolint:gomnd // Minutes of the day
+	)
+
+	if start <= end {
+		return current >= start && current < end, nil
+	}
+
+	return current >= start || current < end, nil
+}
+
+// parseRate converts rates like 512KB, 2MB or 1.5MB/s into KB/s
+func parseRate(rate string) (int, error) {
+	match := rateRE.FindStringSubmatch(strings.TrimSpace(rate))
+	if match == nil {
+		return 0, errors.Errorf("invalid upload rate %q, use a rate like 512KB or 2MB", rate)
+	}
+
+	value, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "parsing upload rate %q", rate)
+	}
+
+	switch strings.ToUpper(match[2]) {
+	case "M":
+		value *= 1024 //nolint:gomnd // KB per MB
+	case "G":
+		value *= 1024 * 1024 //nolint:gomnd // KB per GB
+	}
+
+	if value < 1 {
+		return 0, errors.Errorf("upload rate %q is below 1KB/s", rate)
+	}
+
+	return int(value), nil
+}
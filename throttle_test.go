@@ -0,0 +1,89 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Throttling", func() {
+	at := func(clock string) time.Time {
+		t, err := time.Parse(throttleTimeFormat, clock)
+		Expect(err).NotTo(HaveOccurred())
+		return t
+	}
+
+	t := throttleConfig{Bandwidth: []bandwidthWindow{
+		{From: "08:00", To: "18:00", Upload: "2MB"},
+		{From: "22:00", To: "06:00", Upload: "512KB/s"},
+	}}
+
+	It("should limit the upload within the windows", func() {
+		Expect(t.validate()).To(Succeed())
+
+		Expect(t.uploadLimit(at("08:00"), time.Minute)).To(Equal(2048))
+		Expect(t.uploadLimit(at("17:59"), time.Minute)).To(Equal(2048))
+		Expect(t.uploadLimit(at("18:00"), time.Minute)).To(Equal(0))
+		Expect(t.uploadLimit(at("23:30"), time.Minute)).To(Equal(512))
+		Expect(t.uploadLimit(at("05:00"), time.Minute)).To(Equal(512))
+		Expect(t.uploadLimit(at("07:00"), time.Minute)).To(Equal(0))
+	})
+
+	It("should limit runs reaching into a window", func() {
+		Expect(t.uploadLimit(at("07:00"), time.Hour)).To(Equal(0))
+		Expect(t.uploadLimit(at("07:00"), 90*time.Minute)).To(Equal(2048))
+		Expect(t.uploadLimit(at("20:00"), 3*time.Hour)).To(Equal(512))
+		Expect(t.uploadLimit(at("02:00"), 8*time.Hour)).To(Equal(512))
+
+		// Without maximum runtime every window might be reached
+		Expect(t.uploadLimit(at("07:00"), 0)).To(Equal(512))
+		Expect(throttleConfig{}.uploadLimit(at("07:00"), 0)).To(Equal(0))
+	})
+
+	It("should require the commands to apply the settings", func() {
+		Expect(t.requiredCommands()).To(Equal([]string{"trickle"}))
+		Expect(throttleConfig{Nice: 10}.requiredCommands()).To(Equal([]string{"nice"}))
+		Expect(throttleConfig{}.checkCommands()).To(Succeed())
+	})
+
+	It("should fail to wrap the command without the required commands", func() {
+		path := os.Getenv("PATH")
+		defer os.Setenv("PATH", path) //nolint:errcheck // Restoring the environment of the test
+
+		Expect(os.Setenv("PATH", "")).To(Succeed())
+
+		_, _, err := t.wrapCommand(at("09:00"), time.Hour, "duplicity", "full")
+		Expect(err).To(MatchError(ContainSubstring("trickle")))
+
+		name, args, err := throttleConfig{}.wrapCommand(at("09:00"), time.Hour, "duplicity", "full")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(append([]string{name}, args...)).To(Equal([]string{"duplicity", "full"}))
+	})
+
+	It("should reject invalid settings", func() {
+		Expect(throttleConfig{Bandwidth: []bandwidthWindow{{From: "8am", To: "18:00", Upload: "2MB"}}}.validate()).NotTo(Succeed())
+		Expect(throttleConfig{Bandwidth: []bandwidthWindow{{From: "08:00", To: "18:00", Upload: "fast"}}}.validate()).NotTo(Succeed())
+		Expect(throttleConfig{Nice: 20}.validate()).NotTo(Succeed())
+	})
+
+	It("should wrap the command", func() {
+		level := 7
+		w := t
+		w.Nice = 10
+		w.IONice.Class = "best-effort"
+		w.IONice.Level = &level
+
+		name, args := w.buildCommand(at("09:00"), time.Hour, "duplicity", "full")
+		Expect(append([]string{name}, args...)).To(Equal([]string{
+			"nice", "-n", "10",
+			"ionice", "-c", "2", "-n", "7",
+			"trickle", "-s", "-u", "2048",
+			"duplicity", "full",
+		}))
+
+		name, args = throttleConfig{}.buildCommand(at("09:00"), time.Hour, "duplicity", "full")
+		Expect(append([]string{name}, args...)).To(Equal([]string{"duplicity", "full"}))
+	})
+})
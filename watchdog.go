@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+type (
+	// timeoutError is returned when duplicity was stopped by the
+	// watchdog to report it distinct from other failures
+	timeoutError struct {
+		reason string
+	}
+
+	// watchdog cancels its context when the maximum runtime of the
+	// command is exceeded or no output was seen for too long
+	watchdog struct {
+		ctx    context.Context
+		cancel context.CancelFunc
+
+		noOutput      time.Duration
+		runtimeTimer  *time.Timer
+		noOutputTimer *time.Timer
+		expired       atomic.Value
+	}
+)
+
+func (t timeoutError) Error() string { return t.reason }
+
+// newWatchdog creates a watchdog for the given duplicity command using
+// the configured timeouts. Without timeouts the watchdog only passes
+// through interrupts.
+func (c *configFile) newWatchdog(command string) *watchdog {
+	parent := interruptCtx
+	if c.activeRemoteLock != nil {
+		// Losing the remote lock stops duplicity as well
+		parent = c.activeRemoteLock.ctx
+	}
+
+	w := &watchdog{noOutput: c.Timeouts.NoOutput}
+	w.ctx, w.cancel = context.WithCancel(parent)
+
+	if maxRuntime := c.maxRuntime(command); maxRuntime > 0 {
+		w.runtimeTimer = time.AfterFunc(maxRuntime, func() {
+			w.expire(fmt.Sprintf("maximum runtime of %s exceeded", maxRuntime))
+		})
+	}
+
+	if w.noOutput > 0 {
+		w.noOutputTimer = time.AfterFunc(w.noOutput, func() {
+			w.expire(fmt.Sprintf("no output received for %s", w.noOutput))
+		})
+	}
+
+	return w
+}
+
+// maxRuntime returns the configured maximum runtime of the command or 0
+// if the runtime is not limited
+func (c *configFile) maxRuntime(command string) time.Duration {
+	switch command {
+	case commandRemove:
+		// Removal of old backups shares the timeout of the cleanup command
+		command = commandCleanup
+	case commandRestorePaths:
+		command = commandRestore
+	}
+
+	return c.Timeouts.Commands[command]
+}
+
+// seen resets the no-output timer as the command is still alive
+func (w *watchdog) seen() {
+	if w.noOutputTimer != nil {
+		w.noOutputTimer.Reset(w.noOutput)
+	}
+}
+
+// err returns a timeoutError if the watchdog stopped the command or
+// the remoteLockLostError if the command was stopped due to the loss of
+// the remote lock
+func (w *watchdog) err() error {
+	if reason, ok := w.expired.Load().(string); ok {
+		return timeoutError{reason: reason}
+	}
+
+	var lost remoteLockLostError
+	if errors.As(context.Cause(w.ctx), &lost) {
+		return lost
+	}
+
+	return nil
+}
+
+func (w *watchdog) expire(reason string) {
+	if !w.expired.CompareAndSwap(nil, reason) {
+		return
+	}
+
+	logrus.Errorf("Watchdog stopping duplicity: %s", reason)
+	w.cancel()
+}
+
+func (w *watchdog) stop() {
+	for _, t := range []*time.Timer{w.runtimeTimer, w.noOutputTimer} {
+		if t != nil {
+			t.Stop()
+		}
+	}
+
+	w.cancel()
+}
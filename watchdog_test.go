@@ -0,0 +1,77 @@
+package main
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Watchdog", func() {
+	var config *configFile
+
+	BeforeEach(func() {
+		config = &configFile{}
+		config.Timeouts.Commands = map[string]time.Duration{}
+	})
+
+	It("should map internal commands to their configured runtime", func() {
+		config.Timeouts.Commands[commandCleanup] = time.Hour
+		config.Timeouts.Commands[commandRestore] = 2 * time.Hour
+
+		Expect(config.maxRuntime(commandRemove)).To(Equal(time.Hour))
+		Expect(config.maxRuntime(commandRestorePaths)).To(Equal(2 * time.Hour))
+		Expect(config.maxRuntime(commandBackup)).To(BeZero())
+	})
+
+	It("should not expire without timeouts", func() {
+		w := config.newWatchdog(commandBackup)
+		defer w.stop()
+
+		Consistently(w.ctx.Done(), 100*time.Millisecond).ShouldNot(BeClosed())
+		Expect(w.err()).To(BeNil())
+	})
+
+	It("should expire when the maximum runtime is exceeded", func() {
+		config.Timeouts.Commands[commandBackup] = 50 * time.Millisecond
+
+		w := config.newWatchdog(commandBackup)
+		defer w.stop()
+
+		// Output does not extend the maximum runtime
+		for i := 0; i < 5; i++ {
+			w.seen()
+			time.Sleep(20 * time.Millisecond)
+		}
+
+		Eventually(w.ctx.Done()).Should(BeClosed())
+		Expect(w.err()).To(Equal(timeoutError{reason: "maximum runtime of 50ms exceeded"}))
+		Expect(exitCode(w.err())).To(Equal(exitCodeTimeout))
+	})
+
+	It("should expire when no output was seen", func() {
+		config.Timeouts.NoOutput = 50 * time.Millisecond
+
+		w := config.newWatchdog(commandBackup)
+		defer w.stop()
+
+		for i := 0; i < 5; i++ {
+			w.seen()
+			time.Sleep(20 * time.Millisecond)
+		}
+		Expect(w.err()).To(BeNil())
+
+		Eventually(w.ctx.Done()).Should(BeClosed())
+		Expect(w.err()).To(Equal(timeoutError{reason: "no output received for 50ms"}))
+	})
+
+	It("should not report a timeout when stopped", func() {
+		config.Timeouts.NoOutput = 50 * time.Millisecond
+
+		w := config.newWatchdog(commandBackup)
+		w.stop()
+
+		Expect(w.ctx.Done()).To(BeClosed())
+		Consistently(w.err, 100*time.Millisecond).Should(BeNil())
+	})
+})